@@ -2,61 +2,269 @@ package cmd
 
 import (
 	"log"
+	"path/filepath"
 	"wangweizZZ/go-daily-study/file-transfer/internal"
 
+	"github.com/pkg/errors"
 	"github.com/urfave/cli/v2"
 )
 
+var clientFlags = []cli.Flag{
+	&cli.BoolFlag{
+		Name:  "server_tls",
+		Usage: "Connection uses TLS if true, else plain TCP",
+		Value: false,
+	},
+	&cli.StringFlag{
+		Name:  "ca_file",
+		Usage: "The TLS cert file",
+	},
+	&cli.StringFlag{
+		Name:  "cert_file",
+		Usage: "The TLS client cert file, for servers that require client certificates",
+	},
+	&cli.StringFlag{
+		Name:  "key_file",
+		Usage: "The TLS client key file",
+	},
+	&cli.StringFlag{
+		Name:  "server_host_override",
+		Usage: "The server name used to verify the hostname returned by the TLS handshake",
+	},
+	&cli.StringFlag{
+		Name:    "token",
+		Usage:   "The bearer token sent to servers that require authentication",
+		EnvVars: []string{"FILE_TRANSFER_TOKEN"},
+	},
+	&cli.StringFlag{
+		Name:  "server_addr",
+		Usage: "The transfer address",
+		Value: "localhost:10000",
+	},
+}
+
 var Client = cli.Command{
-	Name:   "client",
-	Usage:  "run transfer client",
-	Action: clientAction,
-	Flags: []cli.Flag{
-		&cli.BoolFlag{
-			Name:  "server_tls",
-			Usage: "Connection uses TLS if true, else plain TCP",
-			Value: false,
-		},
-		&cli.BoolFlag{
-			Name:  "ca_file",
-			Usage: "The TLS cert file",
-		},
-		&cli.StringFlag{
-			Name:  "server_host_override",
-			Usage: "The server name used to verify the hostname returned by the TLS handshake",
-		},
-		&cli.StringFlag{
-			Name:  "server_addr",
-			Usage: "The transfer address",
-			Value: "localhost:10000",
-		},
-		&cli.StringFlag{
-			Name:  "file",
-			Usage: "The transfer file",
-			Value: "",
-		},
+	Name:      "client",
+	Usage:     "run transfer client",
+	ArgsUsage: "[file or glob...]",
+	Before:    loadClientConfig,
+	Action:    clientAction,
+	Flags:     append(uploadFlags, clientFlags...),
+	//a file called watch is sent with -file watch
+	Subcommands: []*cli.Command{&Watch},
+}
+
+// uploadFlags are the settings of client only, the other commands share
+// clientFlags.
+var uploadFlags = append([]cli.Flag{
+	&cli.StringSliceFlag{
+		Name:  "file",
+		Usage: "The transfer file or glob, may be repeated",
+	},
+	&cli.IntFlag{
+		Name:  "jobs",
+		Usage: "The number of files uploaded at once",
+		Value: 4,
+	},
+	&cli.StringFlag{
+		Name:  "dir",
+		Usage: "The directory to transfer recursively, used instead of file",
+	},
+	&cli.StringSliceFlag{
+		Name:  "include",
+		Usage: "Only transfer files of dir matching one of these patterns",
+	},
+	&cli.StringSliceFlag{
+		Name:  "exclude",
+		Usage: "Skip files and directories of dir matching one of these patterns",
+	},
+	&cli.StringFlag{
+		Name:    "limit_rate",
+		Aliases: []string{"limit-rate"},
+		Usage:   "The upload rate limit such as 512K or 10MB/s, unlimited if empty",
+	},
+	&cli.StringFlag{
+		Name:  "codec",
+		Usage: "Compress uploads with auto, zstd, gzip or none, chunks that do not shrink are sent as is",
+		Value: "auto",
+	},
+	&cli.StringFlag{
+		Name:  "digest",
+		Usage: "The digest the server verifies uploads with, sha256 or md5",
+		Value: "sha256",
+	},
+	&cli.IntFlag{
+		Name:  "parallel",
+		Usage: "The number of concurrent streams used to upload the file",
+		Value: 1,
+	},
+	&cli.BoolFlag{
+		Name:  "delta",
+		Usage: "Send only the changed blocks of files the server already has",
+	},
+}, retryFlags...)
+
+// retryFlags are the settings of client that download reads too.
+var retryFlags = []cli.Flag{
+	&cli.IntFlag{
+		Name:  "retries",
+		Usage: "How often a file is tried when the connection drops, 1 never retries",
+		Value: internal.DefaultRetryPolicy.MaxAttempts,
+	},
+	&cli.DurationFlag{
+		Name:  "retry_deadline",
+		Usage: "How long a file may take including its retries",
+		Value: internal.DefaultRetryPolicy.Deadline,
 	},
 }
 
-func clientAction(c *cli.Context) (err error) {
+func newClient(c *cli.Context, opts ...internal.ClientOption) internal.Client {
 	var (
-		clientTls          = c.Bool("client_tls")
+		serverTls          = c.Bool("server_tls")
 		caFile             = c.String("ca_file")
 		serverAddr         = c.String("server_addr")
 		serverHostOverride = c.String("server_host_override")
-		file               = c.String("file")
+		certFile           = c.String("cert_file")
+		keyFile            = c.String("key_file")
+		token              = c.String("token")
 	)
 
-	var client internal.Client
-	if clientTls {
-		client = internal.NewGrpcClient(serverAddr, internal.NewClientConfig(internal.WithClientTls(caFile, serverHostOverride)))
-	} else {
-		client = internal.NewGrpcClient(serverAddr, internal.DefaultClientConfig)
+	if serverTls {
+		opts = append(opts, internal.WithClientTls(caFile, serverHostOverride), internal.WithClientCert(certFile, keyFile))
 	}
-	err = client.Transfer(file)
+	if token != "" {
+		opts = append(opts, internal.WithToken(token))
+	}
+	opts = append(opts, internal.WithClientLogger(newLogger(c)))
+	return internal.NewGrpcClient(serverAddr, internal.NewClientConfig(opts...))
+}
+
+func clientAction(c *cli.Context) (err error) {
+	if err = checkClientConfig(c); err != nil {
+		return err
+	}
+	var (
+		dir  = c.String("dir")
+		jobs = c.Int("jobs")
+	)
+	files, err := expandFiles(append(c.StringSlice("file"), c.Args().Slice()...))
 	if err != nil {
-		panic(err.Error())
+		return err
+	}
+	if dir == "" && len(files) == 0 {
+		return errors.New("nothing to transfer, give files or -dir")
+	}
+
+	opts, err := uploadOptions(c)
+	if err != nil {
+		return err
+	}
+	opts = append(opts, internal.WithProgress(newProgressPrinter(jobs > 1 && (dir != "" || len(files) > 1))))
+	client := newClient(c, opts...)
+	defer client.Close()
+	if dir != "" {
+		if err = client.TransferDir(dir, c.StringSlice("include"), c.StringSlice("exclude")); err != nil {
+			return err
+		}
+		log.Println("tansfer finish")
+		return nil
+	}
+
+	var failed int
+	for _, r := range client.TransferFiles(files) {
+		if r.Err != nil {
+			failed++
+			log.Println("FAIL", r.Path, r.Err)
+		} else {
+			log.Println("ok  ", r.Path)
+		}
+	}
+	log.Printf("tansfer finish: %d succeeded, %d failed", len(files)-failed, failed)
+	if failed > 0 {
+		return errors.Errorf("%d of %d files failed", failed, len(files))
+	}
+	return nil
+}
+
+// uploadOptions are the client options of the upload settings.
+func uploadOptions(c *cli.Context) ([]internal.ClientOption, error) {
+	limitRate, err := internal.ParseRate(c.String("limit_rate"))
+	if err != nil {
+		return nil, err
+	}
+	codecs, err := internal.ParseCodecs(c.String("codec"))
+	if err != nil {
+		return nil, err
+	}
+	digest, err := internal.ParseDigest(c.String("digest"))
+	if err != nil {
+		return nil, err
+	}
+	retry, err := retryPolicy(c)
+	if err != nil {
+		return nil, err
+	}
+	return []internal.ClientOption{
+		internal.WithRetry(retry), internal.WithParallel(c.Int("parallel")), internal.WithLimitRate(limitRate), internal.WithCodecs(codecs...),
+		internal.WithDigest(digest), internal.WithJobs(c.Int("jobs")), internal.WithDelta(c.Bool("delta")),
+	}, nil
+}
+
+// checkClientConfig reports settings of client that do not go together
+// or do not parse before anything is sent.
+func checkClientConfig(c *cli.Context) error {
+	if (c.String("cert_file") == "") != (c.String("key_file") == "") {
+		return errors.New("cert_file and key_file go together")
+	}
+	if c.String("server_addr") == "" {
+		return errors.New("server_addr is required")
+	}
+	if _, err := internal.ParseRate(c.String("limit_rate")); err != nil {
+		return errors.Wrap(err, "limit_rate")
+	}
+	if _, err := internal.ParseCodecs(c.String("codec")); err != nil {
+		return errors.Wrap(err, "codec")
+	}
+	if _, err := internal.ParseDigest(c.String("digest")); err != nil {
+		return errors.Wrap(err, "digest")
+	}
+	if c.Int("jobs") < 1 || c.Int("parallel") < 1 {
+		return errors.New("jobs and parallel must be positive")
+	}
+	_, err := retryPolicy(c)
+	return err
+}
+
+// retryPolicy is the retry policy of the retry settings.
+func retryPolicy(c *cli.Context) (internal.RetryPolicy, error) {
+	retry := internal.DefaultRetryPolicy
+	retry.MaxAttempts = c.Int("retries")
+	retry.Deadline = c.Duration("retry_deadline")
+	if retry.MaxAttempts < 1 || retry.Deadline <= 0 {
+		return retry, errors.New("retries and retry_deadline must be positive")
+	}
+	return retry, nil
+}
+
+// expandFiles resolves globs, a pattern that matches nothing is kept as
+// is so the upload reports it missing. Duplicates are dropped.
+func expandFiles(patterns []string) ([]string, error) {
+	var files []string
+	seen := make(map[string]bool)
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, errors.Wrapf(err, "bad pattern %s", pattern)
+		}
+		if len(matches) == 0 {
+			matches = []string{pattern}
+		}
+		for _, m := range matches {
+			if !seen[m] {
+				seen[m] = true
+				files = append(files, m)
+			}
+		}
 	}
-	log.Println("tansfer finish")
-	return
+	return files, nil
 }
@@ -0,0 +1,370 @@
+package cmd
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v2"
+)
+
+// config_env_prefix comes before the upper cased flag name in the
+// environment variable of a setting, such as FILE_TRANSFER_LISTEN.
+const config_env_prefix = "FILE_TRANSFER_"
+
+// ConfigFlag names the YAML or TOML file settings are read from.
+var ConfigFlag = &cli.StringFlag{
+	Name:    "config",
+	Usage:   "Read settings from this YAML or TOML file, flags and FILE_TRANSFER_* variables take precedence",
+	EnvVars: []string{"FILE_TRANSFER_CONFIG"},
+}
+
+// configSections are the sections of a config file, their keys are the
+// names of these flags.
+var configSections = map[string][]cli.Flag{
+	"server": serverFlags,
+	"client": append(append([]cli.Flag(nil), uploadFlags...), clientFlags...),
+}
+
+// commandSections is the section every command reads.
+var commandSections = map[string]string{
+	"server":      "server",
+	"client":      "client",
+	"download":    "client",
+	"ls":          "client",
+	"stat":        "client",
+	"rm":          "client",
+	"mv":          "client",
+	"limit":       "client",
+	"transfers":   "client",
+	"share":       "client",
+	"unshare":     "client",
+	"watch":       "client",
+	"replication": "client",
+}
+
+var Config = cli.Command{
+	Name:  "config",
+	Usage: "inspect the configuration",
+	Subcommands: []*cli.Command{
+		{
+			Name:  "print",
+			Usage: "print the effective configuration of server or client and where every setting came from",
+			Subcommands: []*cli.Command{
+				{
+					Name:   "server",
+					Usage:  "print the configuration the server would run with",
+					Action: configPrintAction,
+					Flags:  configSections["server"],
+				},
+				{
+					Name:   "client",
+					Usage:  "print the configuration the client commands would run with",
+					Action: configPrintAction,
+					Flags:  configSections["client"],
+				},
+			},
+		},
+	},
+}
+
+// loadConfig layers the environment and the config file under the flags
+// of a command, see layerConfig.
+func loadConfig(c *cli.Context) error {
+	_, err := layerConfig(c, commandSections[c.Command.Name], c.Command.Flags)
+	return err
+}
+
+// loadClientConfig is loadConfig of client, which runs as an app of its
+// own to hold watch and so has no command in its context.
+func loadClientConfig(c *cli.Context) error {
+	_, err := layerConfig(c, "client", c.App.Flags)
+	return err
+}
+
+// layerConfig sets the flags that were not given. Every setting comes
+// from the first of: the flag, its environment variable, the section of
+// the config file, the default. It returns where each setting came from.
+func layerConfig(c *cli.Context, section string, flags []cli.Flag) (map[string]string, error) {
+	path := c.String(ConfigFlag.Name)
+	conf, err := readConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	values := conf[section]
+
+	onCommandLine := make(map[string]bool)
+	for _, name := range c.LocalFlagNames() {
+		onCommandLine[name] = true
+	}
+
+	sources := make(map[string]string)
+	for _, f := range flags {
+		name := f.Names()[0]
+		if lookupConfigFlag(configSections[section], name) == nil {
+			//command specific flags such as ls' are not settings
+			continue
+		}
+		switch {
+		case anyName(f, func(n string) bool { return onCommandLine[n] }):
+			sources[name] = "flag"
+		case anyName(f, c.IsSet):
+			//set by a variable the flag itself lists, such as FILE_TRANSFER_TOKEN
+			sources[name] = "env"
+		default:
+			env := config_env_prefix + strings.ToUpper(name)
+			if value, ok := os.LookupEnv(env); ok {
+				if err = setFlag(c, f, splitEnv(f, value)); err != nil {
+					return nil, errors.Wrap(err, env)
+				}
+				sources[name] = "env"
+			} else if value, ok := values[name]; ok {
+				items, err := configValues(value)
+				if err == nil {
+					err = setFlag(c, f, items)
+				}
+				if err != nil {
+					return nil, errors.Wrapf(err, "%s: %s.%s", path, section, name)
+				}
+				sources[name] = "file"
+			} else {
+				sources[name] = "default"
+			}
+		}
+	}
+	return sources, nil
+}
+
+// readConfig reads a config file and rejects sections and keys nothing
+// reads, the format follows the extension. An empty path is no file.
+func readConfig(path string) (map[string]map[string]interface{}, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var conf map[string]map[string]interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(data, &conf)
+	case ".toml":
+		_, err = toml.Decode(string(data), &conf)
+	default:
+		return nil, errors.Errorf("%s: unknown config format, use .yaml, .yml or .toml", path)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, path)
+	}
+
+	for _, section := range sortedSections(conf) {
+		flags, ok := configSections[section]
+		if !ok {
+			return nil, errors.Errorf("%s: unknown section %q, use server or client", path, section)
+		}
+		keys := make([]string, 0, len(conf[section]))
+		for key := range conf[section] {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		//values are parsed into a set of their own, so settings of other
+		//commands are checked too
+		set := flag.NewFlagSet(section, flag.ContinueOnError)
+		for _, key := range keys {
+			f := lookupConfigFlag(flags, key)
+			if f == nil {
+				return nil, errors.Errorf("%s: unknown setting %s.%s", path, section, key)
+			}
+			if err = checkFlag(f).Apply(set); err != nil {
+				return nil, err
+			}
+			values, err := configValues(conf[section][key])
+			if err == nil {
+				err = setFlag(set, f, values)
+			}
+			if err != nil {
+				return nil, errors.Wrapf(err, "%s: %s.%s", path, section, key)
+			}
+		}
+	}
+	return conf, nil
+}
+
+// checkFlag returns a copy of f to check values of the file with. Apply
+// binds the value of a list flag to the set, the values checked would be
+// added to the shared flag and so to the command line too.
+func checkFlag(f cli.Flag) cli.Flag {
+	if list, ok := f.(*cli.StringSliceFlag); ok {
+		checked := *list
+		checked.Value = cli.NewStringSlice()
+		checked.Destination = nil
+		return &checked
+	}
+	return f
+}
+
+func sortedSections(conf map[string]map[string]interface{}) []string {
+	sections := make([]string, 0, len(conf))
+	for section := range conf {
+		sections = append(sections, section)
+	}
+	sort.Strings(sections)
+	return sections
+}
+
+// lookupConfigFlag finds a flag by its name, aliases are not settings.
+func lookupConfigFlag(flags []cli.Flag, name string) cli.Flag {
+	for _, f := range flags {
+		if f.Names()[0] == name {
+			return f
+		}
+	}
+	return nil
+}
+
+func anyName(f cli.Flag, fn func(string) bool) bool {
+	for _, name := range f.Names() {
+		if fn(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// configValues turns a value of the file into flag values, lists are
+// only taken by list flags.
+func configValues(value interface{}) ([]string, error) {
+	if value == nil {
+		return nil, errors.New("missing value")
+	}
+	if items, ok := value.([]interface{}); ok {
+		values := make([]string, len(items))
+		for i, item := range items {
+			if !isScalar(item) {
+				return nil, errors.New("lists may only hold plain values")
+			}
+			values[i] = fmt.Sprint(item)
+		}
+		return values, nil
+	}
+	if !isScalar(value) {
+		return nil, errors.New("expected a plain value or a list")
+	}
+	return []string{fmt.Sprint(value)}, nil
+}
+
+func isScalar(value interface{}) bool {
+	if value == nil {
+		return false
+	}
+	switch reflect.ValueOf(value).Kind() {
+	case reflect.Map, reflect.Slice, reflect.Array, reflect.Struct:
+		return false
+	}
+	return true
+}
+
+// splitEnv splits the variable of a list flag on commas.
+func splitEnv(f cli.Flag, value string) []string {
+	if _, ok := f.(*cli.StringSliceFlag); !ok {
+		return []string{value}
+	}
+	var values []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			values = append(values, item)
+		}
+	}
+	return values
+}
+
+// flagSetter is a cli.Context or a flag.FlagSet.
+type flagSetter interface {
+	Set(name string, value string) error
+}
+
+func setFlag(set flagSetter, f cli.Flag, values []string) error {
+	name := f.Names()[0]
+	if _, ok := f.(*cli.StringSliceFlag); !ok && len(values) != 1 {
+		return errors.New("expected a single value")
+	}
+	for _, value := range values {
+		if err := set.Set(name, value); err != nil {
+			return errors.Errorf("invalid value %q", value)
+		}
+	}
+	return nil
+}
+
+func configPrintAction(c *cli.Context) error {
+	sources, err := layerConfig(c, c.Command.Name, c.Command.Flags)
+	if err != nil {
+		return err
+	}
+	check := checkClientConfig
+	if c.Command.Name == "server" {
+		check = checkServerConfig
+	}
+	if err = check(c); err != nil {
+		return err
+	}
+
+	fmt.Printf("%s:\n", c.Command.Name)
+	for _, f := range configSections[c.Command.Name] {
+		name := f.Names()[0]
+		fmt.Printf("  %s: %s # %s\n", name, formatSetting(c, f), sources[name])
+	}
+	return nil
+}
+
+// secretSettings are masked by config print.
+var secretSettings = map[string]bool{
+	"token":         true,
+	"s3_secret_key": true,
+	"replica_token": true,
+}
+
+// formatSetting writes the value of a flag as YAML.
+func formatSetting(c *cli.Context, f cli.Flag) string {
+	name := f.Names()[0]
+	var value interface{}
+	switch f.(type) {
+	case *cli.BoolFlag:
+		value = c.Bool(name)
+	case *cli.IntFlag:
+		value = c.Int(name)
+	case *cli.DurationFlag:
+		value = c.Duration(name).String()
+	case *cli.StringSliceFlag:
+		items := make([]string, 0, len(c.StringSlice(name)))
+		for _, item := range c.StringSlice(name) {
+			items = append(items, formatSettingValue(item))
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	default:
+		value = c.String(name)
+		if secretSettings[name] && value != "" {
+			value = "<hidden>"
+		}
+	}
+	return formatSettingValue(value)
+}
+
+func formatSettingValue(value interface{}) string {
+	out, err := yaml.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return strings.TrimSpace(string(out))
+}
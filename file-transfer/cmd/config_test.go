@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/urfave/cli/v2"
+)
+
+func TestLayerConfigList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yaml")
+	if err = ioutil.WriteFile(path, []byte("server:\n  replicate_to: [a:1, b:2]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	replicateTo := lookupConfigFlag(serverFlags, "replicate_to").(*cli.StringSliceFlag)
+	defer func(value *cli.StringSlice) { replicateTo.Value = value }(replicateTo.Value)
+
+	tests := []struct {
+		name string
+		args []string
+		env  string
+		want []string
+	}{
+		{"file", nil, "", []string{"a:1", "b:2"}},
+		{"file again", nil, "", []string{"a:1", "b:2"}},
+		{"flag over file", []string{"--replicate_to", "z:9"}, "", []string{"z:9"}},
+		{"repeated flag over file", []string{"--replicate_to", "z:9", "--replicate_to", "y:8"}, "", []string{"z:9", "y:8"}},
+		{"env over file", nil, "x:7, w:6", []string{"x:7", "w:6"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			//the app binds the shared flag, a fresh value keeps runs apart
+			replicateTo.Value = nil
+			if tt.env != "" {
+				os.Setenv(config_env_prefix+"REPLICATE_TO", tt.env)
+				defer os.Unsetenv(config_env_prefix + "REPLICATE_TO")
+			}
+
+			var got []string
+			app := &cli.App{
+				Flags: []cli.Flag{ConfigFlag},
+				Commands: []*cli.Command{{
+					Name:   "server",
+					Flags:  serverFlags,
+					Before: loadConfig,
+					Action: func(c *cli.Context) error {
+						got = c.StringSlice("replicate_to")
+						return nil
+					},
+				}},
+			}
+			args := append([]string{"file-transfer", "--config", path, "server"}, tt.args...)
+			if err := app.Run(args); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("replicate_to is %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadConfigLeavesFlags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.toml")
+	if err = ioutil.WriteFile(path, []byte("[client]\ninclude = [\"*.go\", \"*.md\"]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	include := lookupConfigFlag(uploadFlags, "include").(*cli.StringSliceFlag)
+	defer func(value *cli.StringSlice) { include.Value = value }(include.Value)
+	include.Value = cli.NewStringSlice()
+	for i := 0; i < 2; i++ {
+		if _, err = readConfig(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := include.Value.Value(); len(got) != 0 {
+		t.Errorf("reading the file set include to %v", got)
+	}
+}
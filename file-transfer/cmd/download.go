@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"log"
+	"strings"
+	"wangweizZZ/go-daily-study/file-transfer/internal"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+var Download = cli.Command{
+	Name:   "download",
+	Usage:  "download a file from the transfer server",
+	Before: loadConfig,
+	Action: downloadAction,
+	Flags: append([]cli.Flag{
+		&cli.StringFlag{
+			Name:  "remote",
+			Usage: "The file name on the server",
+		},
+		&cli.StringFlag{
+			Name:  "share",
+			Usage: "Download through a share link instead, given as its token or url, needs no credentials",
+		},
+		&cli.StringFlag{
+			Name:  "local",
+			Usage: "The local path to write to, defaults to the name of the file on the server",
+		},
+	}, append(retryFlags, clientFlags...)...),
+}
+
+func downloadAction(c *cli.Context) (err error) {
+	var (
+		remote = c.String("remote")
+		local  = c.String("local")
+		share  = c.String("share")
+	)
+	if (remote == "") == (share == "") {
+		return errors.New("download needs either --remote or --share")
+	}
+	if share != "" {
+		//a url ends with the token
+		share = share[strings.LastIndex(share, "/")+1:]
+	} else if local == "" {
+		local = internal.GetName(remote)
+	}
+
+	retry, err := retryPolicy(c)
+	if err != nil {
+		return err
+	}
+	client := newClient(c, internal.WithRetry(retry))
+	defer client.Close()
+	if share != "" {
+		//without --local the server names the file
+		local, err = client.DownloadShared(share, local)
+	} else {
+		err = client.Download(remote, local)
+	}
+	if err != nil {
+		return err
+	}
+	log.Println("download finish:", local)
+	return
+}
@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"time"
+	"wangweizZZ/go-daily-study/file-transfer/internal/proto"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+var Ls = cli.Command{
+	Name:      "ls",
+	Usage:     "list the files on the transfer server",
+	ArgsUsage: "[prefix]",
+	Before:    loadConfig,
+	Action:    lsAction,
+	Flags:     clientFlags,
+}
+
+var Stat = cli.Command{
+	Name:      "stat",
+	Usage:     "show a file on the transfer server",
+	ArgsUsage: "name",
+	Before:    loadConfig,
+	Action:    statAction,
+	Flags:     clientFlags,
+}
+
+var Rm = cli.Command{
+	Name:      "rm",
+	Usage:     "delete files from the transfer server",
+	ArgsUsage: "name...",
+	Before:    loadConfig,
+	Action:    rmAction,
+	Flags:     clientFlags,
+}
+
+var Mv = cli.Command{
+	Name:      "mv",
+	Usage:     "rename a file on the transfer server",
+	ArgsUsage: "from to",
+	Before:    loadConfig,
+	Action:    mvAction,
+	Flags:     clientFlags,
+}
+
+func lsAction(c *cli.Context) error {
+	client := newClient(c)
+	defer client.Close()
+	files, err := client.List(c.Args().First())
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		printFileStat(f)
+	}
+	return nil
+}
+
+func statAction(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return errors.New("stat needs exactly one name")
+	}
+	client := newClient(c)
+	defer client.Close()
+	f, err := client.Stat(c.Args().First())
+	if err != nil {
+		return err
+	}
+	printFileStat(f)
+	return nil
+}
+
+func rmAction(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return errors.New("rm needs at least one name")
+	}
+	client := newClient(c)
+	defer client.Close()
+	for _, name := range c.Args().Slice() {
+		if err := client.Delete(name); err != nil {
+			return errors.Wrapf(err, "rm %s", name)
+		}
+		log.Println("removed", name)
+	}
+	return nil
+}
+
+func mvAction(c *cli.Context) error {
+	if c.NArg() != 2 {
+		return errors.New("mv needs a source and a destination")
+	}
+	client := newClient(c)
+	defer client.Close()
+	return client.Rename(c.Args().Get(0), c.Args().Get(1))
+}
+
+func printFileStat(f *proto.FileStat) {
+	fmt.Printf("%12d  %s  %s\n", f.GetSize(), time.Unix(f.GetModTime(), 0).Format("2006-01-02 15:04:05"), f.GetName())
+}
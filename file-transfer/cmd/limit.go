@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"fmt"
+	"wangweizZZ/go-daily-study/file-transfer/internal"
+
+	"github.com/urfave/cli/v2"
+)
+
+var Limit = cli.Command{
+	Name:   "limit",
+	Usage:  "change the upload rate limits of a running server, needs an admin",
+	Before: loadConfig,
+	Action: limitAction,
+	Flags: append([]cli.Flag{
+		&cli.StringFlag{
+			Name:  "global",
+			Usage: "The rate limit of the whole server such as 100MB/s, 0 for unlimited",
+		},
+		&cli.StringFlag{
+			Name:  "per_client",
+			Usage: "The rate limit of every client such as 10MB/s, 0 for unlimited",
+		},
+	}, clientFlags...),
+}
+
+func limitAction(c *cli.Context) error {
+	//unset flags keep what the server has
+	global, perClient := int64(-1), int64(-1)
+	var err error
+	if c.IsSet("global") {
+		if global, err = internal.ParseRate(c.String("global")); err != nil {
+			return err
+		}
+	}
+	if c.IsSet("per_client") {
+		if perClient, err = internal.ParseRate(c.String("per_client")); err != nil {
+			return err
+		}
+	}
+
+	client := newClient(c)
+	defer client.Close()
+	limit, err := client.SetRateLimit(global, perClient)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("global: %s\nper client: %s\n", formatRate(limit.GetGlobal()), formatRate(limit.GetPerClient()))
+	return nil
+}
+
+func formatRate(rate int64) string {
+	if rate == 0 {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%d B/s", rate)
+}
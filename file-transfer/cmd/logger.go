@@ -0,0 +1,18 @@
+package cmd
+
+import (
+	"os"
+	"wangweizZZ/go-daily-study/file-transfer/internal"
+
+	"github.com/urfave/cli/v2"
+)
+
+// newLogger follows the global debug and log_json flags, debug traces
+// every chunk of an upload.
+func newLogger(c *cli.Context) *internal.Logger {
+	level := internal.LevelInfo
+	if c.Bool("debug") {
+		level = internal.LevelDebug
+	}
+	return internal.NewLogger(os.Stderr, c.Bool("log_json"), level)
+}
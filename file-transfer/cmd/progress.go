@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+	"wangweizZZ/go-daily-study/file-transfer/internal"
+)
+
+const (
+	tty_refresh  = 100 * time.Millisecond
+	log_interval = 5 * time.Second
+)
+
+// newProgressPrinter redraws one status line per upload on a terminal
+// and falls back to a log line every few seconds otherwise, or when
+// several uploads run at once and would fight over the line.
+func newProgressPrinter(concurrent bool) func(internal.Progress) {
+	info, err := os.Stderr.Stat()
+	tty := err == nil && info.Mode()&os.ModeCharDevice != 0 && !concurrent
+	interval := log_interval
+	if tty {
+		interval = tty_refresh
+	}
+
+	var (
+		mu   sync.Mutex
+		last time.Time
+	)
+	return func(p internal.Progress) {
+		mu.Lock()
+		defer mu.Unlock()
+		done := p.Done >= p.Total
+		if !done && time.Since(last) < interval {
+			return
+		}
+		last = time.Now()
+
+		line := fmt.Sprintf("%s  %s / %s  %3.0f%%  %s/s  ETA %s",
+			p.Name, formatBytes(p.Done), formatBytes(p.Total), percent(p.Done, p.Total),
+			formatBytes(int64(p.Rate())), formatETA(p.ETA()))
+		switch {
+		case !tty:
+			log.Println(line)
+		case done:
+			fmt.Fprintf(os.Stderr, "\r\033[K%s\n", line)
+		default:
+			fmt.Fprintf(os.Stderr, "\r\033[K%s", line)
+		}
+	}
+}
+
+func percent(done int64, total int64) float64 {
+	if total == 0 {
+		return 100
+	}
+	return float64(done) * 100 / float64(total)
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func formatETA(d time.Duration) string {
+	if d <= 0 {
+		return "--:--"
+	}
+	d = d.Round(time.Second)
+	h, m, s := d/time.Hour, d%time.Hour/time.Minute, d%time.Minute/time.Second
+	if h > 0 {
+		return fmt.Sprintf("%d:%02d:%02d", h, m, s)
+	}
+	return fmt.Sprintf("%02d:%02d", m, s)
+}
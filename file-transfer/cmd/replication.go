@@ -0,0 +1,41 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+var Replication = cli.Command{
+	Name:   "replication",
+	Usage:  "show how far behind the replication peers of the transfer server are, needs an admin",
+	Before: loadConfig,
+	Action: replicationAction,
+	Flags:  clientFlags,
+}
+
+func replicationAction(c *cli.Context) error {
+	client := newClient(c)
+	defer client.Close()
+	status, err := client.Replication()
+	if err != nil {
+		return err
+	}
+	if len(status.GetPeers()) == 0 {
+		fmt.Println("replication is off")
+		return nil
+	}
+	for _, p := range status.GetPeers() {
+		lastPush := "never"
+		if p.GetLastPush() > 0 {
+			lastPush = time.Unix(p.GetLastPush(), 0).Format(time.RFC3339)
+		}
+		lag := time.Duration(p.GetLagMs()) * time.Millisecond
+		fmt.Printf("%-24s %6d queued  lag %-10s last push %s\n", p.GetPeer(), p.GetQueued(), lag.Round(time.Second), lastPush)
+		if p.GetLastError() != "" {
+			fmt.Printf("  last error: %s\n", p.GetLastError())
+		}
+	}
+	return nil
+}
@@ -1,52 +1,290 @@
 package cmd
 
 import (
+	"time"
 	"wangweizZZ/go-daily-study/file-transfer/internal"
 
+	"github.com/pkg/errors"
 	"github.com/urfave/cli/v2"
 )
 
 var Server = cli.Command{
 	Name:   "server",
 	Usage:  "run transfer server",
+	Before: loadConfig,
 	Action: serverAction,
-	Flags: []cli.Flag{
-		&cli.BoolFlag{
-			Name:  "server_tls",
-			Usage: "Connection uses TLS if true, else plain TCP",
-			Value: false,
-		},
-		&cli.BoolFlag{
-			Name:  "cert_file",
-			Usage: "The TLS cert file",
-		},
-		&cli.StringFlag{
-			Name:  "key_file",
-			Usage: "The TLS key file",
-		},
-		&cli.StringFlag{
-			Name:  "listen",
-			Usage: "The listen address",
-			Value: "localhost:10000",
-		},
+	Flags:  serverFlags,
+}
+
+var serverFlags = []cli.Flag{
+	&cli.BoolFlag{
+		Name:  "server_tls",
+		Usage: "Connection uses TLS if true, else plain TCP",
+		Value: false,
+	},
+	&cli.StringFlag{
+		Name:  "cert_file",
+		Usage: "The TLS cert file",
+	},
+	&cli.StringFlag{
+		Name:  "key_file",
+		Usage: "The TLS key file",
+	},
+	&cli.StringFlag{
+		Name:  "client_ca_file",
+		Usage: "Require client certificates signed by a CA in this file, needs server_tls",
+	},
+	&cli.StringFlag{
+		Name:  "token_file",
+		Usage: "Authenticate clients with the \"name token rw|ro|admin|replica\" lines of this file",
+	},
+	&cli.StringFlag{
+		Name:  "store",
+		Usage: "The directory upload sessions are kept in, and the files too with the local storage",
+		Value: "./tmp/",
+	},
+	&cli.StringFlag{
+		Name:  "storage",
+		Usage: "Where files are kept: local, memory or s3",
+		Value: "local",
+	},
+	&cli.StringFlag{
+		Name:  "s3_endpoint",
+		Usage: "The url of the S3 compatible service, such as http://localhost:9000",
+	},
+	&cli.StringFlag{
+		Name:  "s3_region",
+		Usage: "The region of the bucket",
+		Value: "us-east-1",
+	},
+	&cli.StringFlag{
+		Name:  "s3_bucket",
+		Usage: "The bucket files are kept in",
+	},
+	&cli.StringFlag{
+		Name:    "s3_access_key",
+		Usage:   "The access key of the bucket",
+		EnvVars: []string{"AWS_ACCESS_KEY_ID"},
+	},
+	&cli.StringFlag{
+		Name:    "s3_secret_key",
+		Usage:   "The secret key of the bucket",
+		EnvVars: []string{"AWS_SECRET_ACCESS_KEY"},
+	},
+	&cli.StringFlag{
+		Name:  "s3_part_size",
+		Usage: "Files larger than this are sent to S3 in parts of this size",
+		Value: "16MB",
+	},
+	&cli.StringFlag{
+		Name:  "global_limit_rate",
+		Usage: "The upload rate limit of the whole server such as 100MB/s, unlimited if empty",
+	},
+	&cli.StringFlag{
+		Name:  "client_limit_rate",
+		Usage: "The upload rate limit of every client such as 10MB/s, unlimited if empty",
+	},
+	&cli.StringFlag{
+		Name:  "max_file_size",
+		Usage: "Reject uploads larger than this such as 10GB, unlimited if empty",
+	},
+	&cli.StringFlag{
+		Name:  "quota",
+		Usage: "The space every user may take such as 100GB, the whole store without token_file, unlimited if empty",
+	},
+	&cli.StringFlag{
+		Name:  "metrics_listen",
+		Usage: "Serve Prometheus metrics on this address under /metrics, off if empty",
+	},
+	&cli.StringFlag{
+		Name:  "http_listen",
+		Usage: "Serve uploads and downloads over plain HTTP on this address under /files/, off if empty",
+	},
+	&cli.StringFlag{
+		Name:  "share_url",
+		Usage: "The base url of share links such as https://files.example.com, defaults to the http gateway",
+	},
+	&cli.DurationFlag{
+		Name:  "share_ttl",
+		Usage: "How long share links work unless the client asks otherwise",
+		Value: 24 * time.Hour,
+	},
+	&cli.StringSliceFlag{
+		Name:  "replicate_to",
+		Usage: "Push every committed upload to the server at this address too, may be repeated",
+	},
+	&cli.StringFlag{
+		Name:  "replica_token",
+		Usage: "The bearer token sent to replication peers, a replica user in their token_file",
+	},
+	&cli.BoolFlag{
+		Name:  "replica_tls",
+		Usage: "Connect to replication peers with TLS, the server certificate is presented as client certificate",
+	},
+	&cli.StringFlag{
+		Name:  "replica_ca_file",
+		Usage: "The TLS cert file replication peers are checked against",
+	},
+	&cli.DurationFlag{
+		Name:  "drain_timeout",
+		Usage: "How long running uploads may take to finish on SIGINT or SIGTERM",
+		Value: 30 * time.Second,
+	},
+	&cli.StringFlag{
+		Name:  "listen",
+		Usage: "The listen address",
+		Value: "localhost:10000",
 	},
 }
 
 func serverAction(c *cli.Context) (err error) {
+	if err = checkServerConfig(c); err != nil {
+		return err
+	}
 	var (
-		serverTls = c.Bool("server_tls")
-		certFile  = c.String("cert_file")
-		keyFile   = c.String("key_file")
-		listen    = c.String("listen")
+		serverTls    = c.Bool("server_tls")
+		certFile     = c.String("cert_file")
+		keyFile      = c.String("key_file")
+		clientCaFile = c.String("client_ca_file")
+		tokenFile    = c.String("token_file")
+		store        = c.String("store")
+		listen       = c.String("listen")
 	)
 
-	var server internal.Server
+	globalRate, err := internal.ParseRate(c.String("global_limit_rate"))
+	if err != nil {
+		return err
+	}
+	clientRate, err := internal.ParseRate(c.String("client_limit_rate"))
+	if err != nil {
+		return err
+	}
+
+	maxFileSize, err := internal.ParseSize(c.String("max_file_size"))
+	if err != nil {
+		return err
+	}
+	quota, err := internal.ParseSize(c.String("quota"))
+	if err != nil {
+		return err
+	}
+
+	storage, err := newStorage(c)
+	if err != nil {
+		return err
+	}
+
+	opts := []internal.ServerOption{
+		internal.WithServerStore(store),
+		internal.WithServerStorage(storage),
+		internal.WithServerRateLimit(globalRate, clientRate),
+		internal.WithServerQuota(maxFileSize, quota),
+		internal.WithServerDrainTimeout(c.Duration("drain_timeout")),
+		internal.WithServerShareLinks(c.String("share_url"), c.Duration("share_ttl")),
+		internal.WithServerLogger(newLogger(c)),
+	}
 	if serverTls {
-		server = internal.NewGrpcServer(listen, internal.NewServerConfig(internal.WithServerTls(certFile, keyFile)))
-	} else {
-		server = internal.NewGrpcServer(listen, internal.DefaultServerConfig)
+		opts = append(opts, internal.WithServerTls(certFile, keyFile), internal.WithServerClientCA(clientCaFile))
+	}
+	if tokenFile != "" {
+		opts = append(opts, internal.WithServerTokens(tokenFile))
+	}
+	if metricsListen := c.String("metrics_listen"); metricsListen != "" {
+		opts = append(opts, internal.WithServerMetrics(metricsListen))
+	}
+	if httpListen := c.String("http_listen"); httpListen != "" {
+		opts = append(opts, internal.WithServerHTTP(httpListen))
 	}
+	if peers := c.StringSlice("replicate_to"); len(peers) > 0 {
+		var replicaOpts []internal.ClientOption
+		if c.Bool("replica_tls") {
+			replicaOpts = append(replicaOpts, internal.WithClientTls(c.String("replica_ca_file"), ""), internal.WithClientCert(certFile, keyFile))
+		}
+		if token := c.String("replica_token"); token != "" {
+			replicaOpts = append(replicaOpts, internal.WithToken(token))
+		}
+		opts = append(opts, internal.WithServerReplication(peers, replicaOpts...))
+	}
+	server := internal.NewGrpcServer(listen, internal.NewServerConfig(opts...))
 	err = server.Start()
 	defer server.Close()
 	return
 }
+
+// checkServerConfig reports settings that do not go together or do not
+// parse before anything is started.
+func checkServerConfig(c *cli.Context) error {
+	if c.Bool("server_tls") && (c.String("cert_file") == "" || c.String("key_file") == "") {
+		return errors.New("server_tls needs cert_file and key_file")
+	}
+	if c.String("client_ca_file") != "" && !c.Bool("server_tls") {
+		return errors.New("client_ca_file needs server_tls")
+	}
+	for _, name := range []string{"global_limit_rate", "client_limit_rate"} {
+		if _, err := internal.ParseRate(c.String(name)); err != nil {
+			return errors.Wrap(err, name)
+		}
+	}
+	for _, name := range []string{"max_file_size", "quota", "s3_part_size"} {
+		if _, err := internal.ParseSize(c.String(name)); err != nil {
+			return errors.Wrap(err, name)
+		}
+	}
+	switch c.String("storage") {
+	case "local", "memory":
+	case "s3":
+		if c.String("s3_endpoint") == "" || c.String("s3_bucket") == "" {
+			return errors.New("storage s3 needs s3_endpoint and s3_bucket")
+		}
+	default:
+		return errors.Errorf("storage: unknown storage %q, use local, memory or s3", c.String("storage"))
+	}
+	for _, peer := range c.StringSlice("replicate_to") {
+		if peer == "" || peer == c.String("listen") {
+			return errors.Errorf("invalid replicate_to %q", peer)
+		}
+	}
+	//pushes are told apart from uploads by their replica user, without one
+	//servers replicating to each other send every file back and forth
+	if len(c.StringSlice("replicate_to")) > 0 && (c.String("token_file") == "" || c.String("replica_token") == "") {
+		return errors.New("replicate_to needs token_file and replica_token")
+	}
+	if c.String("replica_ca_file") != "" && !c.Bool("replica_tls") {
+		return errors.New("replica_ca_file needs replica_tls")
+	}
+	if c.Duration("share_ttl") < time.Second {
+		return errors.New("share_ttl must be at least 1s")
+	}
+	if c.Duration("drain_timeout") < 0 {
+		return errors.New("drain_timeout must not be negative")
+	}
+	if c.String("listen") == "" {
+		return errors.New("listen is required")
+	}
+	return nil
+}
+
+func newStorage(c *cli.Context) (internal.Storage, error) {
+	switch c.String("storage") {
+	case "local":
+		return internal.NewLocalStorage(c.String("store")), nil
+	case "memory":
+		return internal.NewMemoryStorage(), nil
+	case "s3":
+		partSize, err := internal.ParseSize(c.String("s3_part_size"))
+		if err != nil {
+			return nil, err
+		}
+		//uploads are staged next to the sessions until they are committed
+		return internal.NewS3Storage(internal.S3Config{
+			Endpoint:  c.String("s3_endpoint"),
+			Region:    c.String("s3_region"),
+			Bucket:    c.String("s3_bucket"),
+			AccessKey: c.String("s3_access_key"),
+			SecretKey: c.String("s3_secret_key"),
+			PartSize:  partSize,
+		}, c.String("store"))
+	default:
+		return nil, errors.Errorf("unknown storage %q", c.String("storage"))
+	}
+}
@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+var Share = cli.Command{
+	Name:      "share",
+	Usage:     "issue a link to a file on the transfer server that works without credentials",
+	ArgsUsage: "name",
+	Before:    loadConfig,
+	Action:    shareAction,
+	Flags: append([]cli.Flag{
+		&cli.DurationFlag{
+			Name:  "ttl",
+			Usage: "How long the link works such as 1h, 0 for the default of the server",
+		},
+		&cli.IntFlag{
+			Name:  "max_downloads",
+			Usage: "How often the file may be downloaded through the link, 0 for no limit",
+		},
+	}, clientFlags...),
+}
+
+var Unshare = cli.Command{
+	Name:      "unshare",
+	Usage:     "revoke a share link before it expires, needs an admin",
+	ArgsUsage: "id|token",
+	Before:    loadConfig,
+	Action:    unshareAction,
+	Flags:     clientFlags,
+}
+
+func shareAction(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return errors.New("share needs exactly one name")
+	}
+	ttl, max := c.Duration("ttl"), c.Int("max_downloads")
+	if ttl < 0 || max < 0 {
+		return errors.New("ttl and max_downloads must not be negative")
+	}
+	if ttl > 0 && ttl < time.Second {
+		return errors.New("ttl must be at least 1s")
+	}
+
+	client := newClient(c)
+	defer client.Close()
+	link, err := client.Share(c.Args().First(), ttl, int32(max))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("id: %s\n", link.GetId())
+	if link.GetUrl() != "" {
+		fmt.Printf("url: %s\n", link.GetUrl())
+	}
+	fmt.Printf("token: %s\n", link.GetToken())
+	fmt.Printf("expires: %s\n", time.Unix(link.GetExpires(), 0).Format(time.RFC3339))
+	if link.GetMaxDownloads() > 0 {
+		fmt.Printf("max downloads: %d\n", link.GetMaxDownloads())
+	}
+	return nil
+}
+
+func unshareAction(c *cli.Context) error {
+	if c.NArg() != 1 {
+		return errors.New("unshare needs exactly one id or token")
+	}
+	client := newClient(c)
+	defer client.Close()
+	return client.RevokeShare(c.Args().First())
+}
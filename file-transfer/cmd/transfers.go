@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+	"wangweizZZ/go-daily-study/file-transfer/internal/proto"
+
+	"github.com/urfave/cli/v2"
+)
+
+var Transfers = cli.Command{
+	Name:   "transfers",
+	Usage:  "watch the uploads in progress on the transfer server, needs an admin",
+	Before: loadConfig,
+	Action: transfersAction,
+	Flags: append([]cli.Flag{
+		&cli.DurationFlag{
+			Name:  "interval",
+			Usage: "The time between two updates",
+			Value: 2 * time.Second,
+		},
+	}, clientFlags...),
+}
+
+func transfersAction(c *cli.Context) error {
+	client := newClient(c)
+	defer client.Close()
+	return client.WatchTransfers(c.Duration("interval"), func(snapshot *proto.TransferSnapshot) error {
+		fmt.Printf("%s  %d active\n", time.Now().Format("15:04:05"), len(snapshot.GetTransfers()))
+		for _, t := range snapshot.GetTransfers() {
+			fmt.Printf("  %-32s %-16s %10s / %-10s %3.0f%%  %s/s  %s\n",
+				t.GetId(), t.GetOwner(), formatBytes(t.GetReceived()), formatBytes(t.GetSize()),
+				percent(t.GetReceived(), t.GetSize()), formatBytes(t.GetRate()), t.GetName())
+		}
+		return nil
+	})
+}
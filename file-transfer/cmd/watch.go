@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+	"wangweizZZ/go-daily-study/file-transfer/internal"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+var Watch = cli.Command{
+	Name:   "watch",
+	Usage:  "keep sending the files of a directory as they appear or change, until SIGINT or SIGTERM",
+	Before: loadConfig,
+	Action: watchAction,
+	Flags:  append(append(watchFlags, withoutFlag(uploadFlags, "file")...), clientFlags...),
+}
+
+// withoutFlag returns flags but for the one called name.
+func withoutFlag(flags []cli.Flag, name string) []cli.Flag {
+	kept := make([]cli.Flag, 0, len(flags))
+	for _, f := range flags {
+		if f.Names()[0] != name {
+			kept = append(kept, f)
+		}
+	}
+	return kept
+}
+
+// watchFlags are the settings of watch only, it shares the rest with
+// client but for file.
+var watchFlags = []cli.Flag{
+	&cli.DurationFlag{
+		Name:  "stable",
+		Usage: "How long a file must go without writes before it is sent",
+		Value: 5 * time.Second,
+	},
+	&cli.BoolFlag{
+		Name:  "poll",
+		Usage: "Walk the directory every poll_interval instead of using inotify",
+	},
+	&cli.DurationFlag{
+		Name:  "poll_interval",
+		Usage: "How often the directory is walked when inotify is not available",
+		Value: 2 * time.Second,
+	},
+	&cli.StringFlag{
+		Name:  "move_to",
+		Usage: "Move files here once the server committed them, keeping their path below dir",
+	},
+	&cli.BoolFlag{
+		Name:  "delete",
+		Usage: "Delete files once the server committed them",
+	},
+	&cli.StringFlag{
+		Name:  "state_file",
+		Usage: "Where the files the server committed are remembered across restarts, defaults to .watch_state in dir",
+	},
+}
+
+func watchAction(c *cli.Context) error {
+	if err := checkClientConfig(c); err != nil {
+		return err
+	}
+	dir := c.String("dir")
+	if dir == "" {
+		return errors.New("watch needs -dir")
+	}
+	if c.Duration("stable") <= 0 || c.Duration("poll_interval") <= 0 {
+		return errors.New("stable and poll_interval must be positive")
+	}
+	if c.String("move_to") != "" && c.Bool("delete") {
+		return errors.New("move_to and delete do not go together")
+	}
+
+	opts, err := uploadOptions(c)
+	if err != nil {
+		return err
+	}
+	client := newClient(c, opts...)
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		select {
+		case <-signals:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return client.Watch(ctx, dir, internal.WatchOptions{
+		Include:      c.StringSlice("include"),
+		Exclude:      c.StringSlice("exclude"),
+		Stable:       c.Duration("stable"),
+		PollInterval: c.Duration("poll_interval"),
+		Poll:         c.Bool("poll"),
+		MoveTo:       c.String("move_to"),
+		Delete:       c.Bool("delete"),
+		StateFile:    c.String("state_file"),
+	})
+}
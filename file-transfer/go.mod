@@ -3,8 +3,13 @@ module wangweizZZ/go-daily-study/file-transfer
 go 1.15
 
 require (
+	github.com/BurntSushi/toml v0.4.1
+	github.com/grpc-ecosystem/go-grpc-prometheus v1.2.0
+	github.com/klauspost/compress v1.13.6
 	github.com/pkg/errors v0.9.1
+	github.com/prometheus/client_golang v1.11.1
 	github.com/urfave/cli/v2 v2.3.0
 	google.golang.org/grpc v1.38.0
 	google.golang.org/protobuf v1.26.0
+	gopkg.in/yaml.v2 v2.4.0
 )
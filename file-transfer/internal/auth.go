@@ -0,0 +1,188 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	auth_header   string = "authorization"
+	bearer_prefix string = "Bearer "
+)
+
+// writeMethods change the store, read only users may not call them.
+var writeMethods = map[string]bool{
+	"/TransferService/Open":   true,
+	"/TransferService/Write":  true,
+	"/TransferService/Delete": true,
+	"/TransferService/Rename": true,
+	"/TransferService/Patch":  true,
+}
+
+// replicaMethods are all a replica user may call: pushing files, and
+// the signatures a Patch starts from.
+var replicaMethods = map[string]bool{
+	"/TransferService/Open":       true,
+	"/TransferService/Write":      true,
+	"/TransferService/Patch":      true,
+	"/TransferService/Signatures": true,
+}
+
+// publicMethods check credentials of their own, such as a share token.
+var publicMethods = map[string]bool{
+	"/TransferService/ReadShared": true,
+}
+
+type user struct {
+	name     string
+	readOnly bool
+	admin    bool
+	// replica users are servers pushing their files, they write to the
+	// whole store instead of a directory of their own and may call
+	// nothing else
+	replica bool
+}
+
+type userKey struct{}
+
+// userFrom returns the authenticated user of ctx, nil when the server
+// runs without a token file.
+func userFrom(ctx context.Context) *user {
+	u, _ := ctx.Value(userKey{}).(*user)
+	return u
+}
+
+// authenticator checks the bearer token of every call against the
+// users loaded from a token file.
+type authenticator struct {
+	users map[string]*user
+}
+
+// loadTokens reads a token file, one "name token rw|ro|admin|replica"
+// entry per line, blank lines and lines starting with # are skipped.
+// Admins and replicas may also write.
+func loadTokens(path string) (*authenticator, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	a := &authenticator{users: make(map[string]*user)}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 3 || (fields[2] != "rw" && fields[2] != "ro" && fields[2] != "admin" && fields[2] != "replica") {
+			return nil, errors.Errorf("%s:%d: want \"name token rw|ro|admin|replica\"", path, line)
+		}
+		//the name becomes a directory of the store
+		if name, err := cleanName(fields[0]); err != nil || name != fields[0] || strings.ContainsAny(name, "/.") {
+			return nil, errors.Errorf("%s:%d: invalid user name %q", path, line, fields[0])
+		}
+		if _, ok := a.users[fields[1]]; ok {
+			return nil, errors.Errorf("%s:%d: duplicate token", path, line)
+		}
+		a.users[fields[1]] = &user{name: fields[0], readOnly: fields[2] == "ro", admin: fields[2] == "admin", replica: fields[2] == "replica"}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *authenticator) authenticate(ctx context.Context, method string) (context.Context, error) {
+	if publicMethods[method] {
+		return ctx, nil
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	var header string
+	if values := md.Get(auth_header); len(values) > 0 {
+		header = values[0]
+	}
+	u, err := a.lookup(header, writeMethods[method])
+	if err != nil {
+		return nil, err
+	}
+	if u.replica && !replicaMethods[method] {
+		return nil, status.Errorf(codes.PermissionDenied, "%s is a replica, it may only push files", u.name)
+	}
+	return context.WithValue(ctx, userKey{}, u), nil
+}
+
+// lookup finds the user of an authorization header, write is set for
+// calls that change the store.
+func (a *authenticator) lookup(header string, write bool) (*user, error) {
+	if !strings.HasPrefix(header, bearer_prefix) {
+		return nil, status.Error(codes.Unauthenticated, "missing bearer token")
+	}
+	u, ok := a.users[strings.TrimPrefix(header, bearer_prefix)]
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "invalid token")
+	}
+	if u.readOnly && write {
+		return nil, status.Errorf(codes.PermissionDenied, "%s is read only", u.name)
+	}
+	return u, nil
+}
+
+func (a *authenticator) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := a.authenticate(ctx, info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (a *authenticator) streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := a.authenticate(ss.Context(), info.FullMethod)
+	if err != nil {
+		return err
+	}
+	return handler(srv, &contextStream{ServerStream: ss, ctx: ctx})
+}
+
+// requireAdmin lets admin users through, a server without a token file
+// only takes admin calls over the loopback interface.
+func requireAdmin(ctx context.Context) error {
+	if u := userFrom(ctx); u != nil {
+		if !u.admin {
+			return status.Errorf(codes.PermissionDenied, "%s is not an admin", u.name)
+		}
+		return nil
+	}
+	p, ok := peer.FromContext(ctx)
+	if ok && p.Addr != nil {
+		if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+			if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+				return nil
+			}
+		}
+	}
+	return status.Error(codes.PermissionDenied, "admin calls are only taken from localhost")
+}
+
+// tokenCredentials attaches a bearer token to every call of a client.
+// It is sent over plain connections too, use tls outside of a test setup.
+type tokenCredentials string
+
+func (t tokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{auth_header: bearer_prefix + string(t)}, nil
+}
+
+func (t tokenCredentials) RequireTransportSecurity() bool {
+	return false
+}
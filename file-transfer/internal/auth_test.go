@@ -0,0 +1,193 @@
+package internal
+
+import (
+	"context"
+	"sort"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const test_tokens = `# name token role
+alice alice-token rw
+bob bob-token rw
+reader reader-token ro
+root root-token admin
+`
+
+func TestLoadTokens(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines string
+		ok    bool
+	}{
+		{"valid", test_tokens, true},
+		{"blank lines", "\n\nalice t rw\n\n", true},
+		{"unknown role", "alice t owner\n", false},
+		{"missing role", "alice t\n", false},
+		{"extra field", "alice t rw x\n", false},
+		{"duplicate token", "alice t rw\nbob t ro\n", false},
+		{"name with slash", "a/b t rw\n", false},
+		{"name with dot", "a.b t rw\n", false},
+		{"dot dot", ".. t rw\n", false},
+		{"session directory", ".sessions t rw\n", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadTokens(writeTokens(t, tt.lines))
+			if (err == nil) != tt.ok {
+				t.Fatalf("loadTokens = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	a, err := loadTokens(writeTokens(t, test_tokens))
+	if err != nil {
+		t.Fatal(err)
+	}
+	type call struct {
+		header string
+		method string
+	}
+	tests := []struct {
+		name string
+		call call
+		code codes.Code
+		user string
+	}{
+		{"no header", call{"", "/TransferService/List"}, codes.Unauthenticated, ""},
+		{"not bearer", call{"Basic alice-token", "/TransferService/List"}, codes.Unauthenticated, ""},
+		{"bare token", call{"alice-token", "/TransferService/List"}, codes.Unauthenticated, ""},
+		{"wrong token", call{"Bearer nobody", "/TransferService/List"}, codes.Unauthenticated, ""},
+		{"token of another case", call{"Bearer ALICE-TOKEN", "/TransferService/List"}, codes.Unauthenticated, ""},
+		{"rw reads", call{"Bearer alice-token", "/TransferService/List"}, codes.OK, "alice"},
+		{"rw writes", call{"Bearer alice-token", "/TransferService/Delete"}, codes.OK, "alice"},
+		{"ro reads", call{"Bearer reader-token", "/TransferService/Read"}, codes.OK, "reader"},
+		{"admin writes", call{"Bearer root-token", "/TransferService/Open"}, codes.OK, "root"},
+		{"share link without token", call{"", "/TransferService/ReadShared"}, codes.OK, ""},
+	}
+	//a read only user may call none of the methods that change the store
+	for method := range writeMethods {
+		tests = append(tests, struct {
+			name string
+			call call
+			code codes.Code
+			user string
+		}{"ro calls " + method, call{"Bearer reader-token", method}, codes.PermissionDenied, ""})
+	}
+	sort.Slice(tests, func(i, j int) bool { return tests[i].name < tests[j].name })
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.call.header != "" {
+				ctx = metadata.NewIncomingContext(ctx, metadata.Pairs(auth_header, tt.call.header))
+			}
+			ctx, err := a.authenticate(ctx, tt.call.method)
+			if status.Code(err) != tt.code {
+				t.Fatalf("got %v, want %s", err, tt.code)
+			}
+			if err != nil {
+				return
+			}
+			var name string
+			if u := userFrom(ctx); u != nil {
+				name = u.name
+			}
+			if name != tt.user {
+				t.Errorf("user %q, want %q", name, tt.user)
+			}
+		})
+	}
+}
+
+func TestRequireAdmin(t *testing.T) {
+	tests := []struct {
+		name string
+		user *user
+		ok   bool
+	}{
+		{"admin", &user{name: "root", admin: true}, true},
+		{"rw", &user{name: "alice"}, false},
+		{"ro", &user{name: "reader", readOnly: true}, false},
+		//without a token file only loopback peers are admins
+		{"anonymous without peer", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			if tt.user != nil {
+				ctx = context.WithValue(ctx, userKey{}, tt.user)
+			}
+			if err := requireAdmin(ctx); (err == nil) != tt.ok {
+				t.Errorf("requireAdmin = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestUserNamespaces(t *testing.T) {
+	ts := startTestServer(t, WithServerTokens(writeTokens(t, test_tokens)))
+	alice := ts.client(t, WithToken("alice-token"))
+	bob := ts.client(t, WithToken("bob-token"))
+	reader := ts.client(t, WithToken("reader-token"))
+
+	if err := alice.Transfer(writeLocal(t, "a.txt", []byte("alice's file"))); err != nil {
+		t.Fatal(err)
+	}
+	if files, err := alice.List(""); err != nil || len(files) != 1 || files[0].GetName() != "a.txt" {
+		t.Fatalf("alice lists %v, %v", files, err)
+	}
+
+	for _, prefix := range []string{"", "a", "alice", "alice/", "../", "../alice/", "/alice"} {
+		files, err := bob.List(prefix)
+		if err != nil || len(files) != 0 {
+			t.Errorf("bob lists %v, %v with prefix %q", files, err, prefix)
+		}
+	}
+	tests := []struct {
+		name string
+		call func() error
+		code codes.Code
+	}{
+		{"stat own name", func() error { _, err := bob.Stat("a.txt"); return err }, codes.NotFound},
+		{"stat key of alice", func() error { _, err := bob.Stat("alice/a.txt"); return err }, codes.NotFound},
+		{"stat up", func() error { _, err := bob.Stat("../alice/a.txt"); return err }, codes.InvalidArgument},
+		{"stat absolute", func() error { _, err := bob.Stat("/alice/a.txt"); return err }, codes.InvalidArgument},
+		{"delete key of alice", func() error { return bob.Delete("alice/a.txt") }, codes.NotFound},
+		{"delete up", func() error { return bob.Delete("../alice/a.txt") }, codes.InvalidArgument},
+		{"rename up", func() error { return bob.Rename("../alice/a.txt", "mine.txt") }, codes.InvalidArgument},
+		{"rename onto alice", func() error { return bob.Rename("a.txt", "../alice/a.txt") }, codes.InvalidArgument},
+		{"share key of alice", func() error { _, err := bob.Share("alice/a.txt", 0, 0); return err }, codes.NotFound},
+		{"ro delete", func() error { return reader.Delete("a.txt") }, codes.PermissionDenied},
+		{"ro rename", func() error { return reader.Rename("a.txt", "b.txt") }, codes.PermissionDenied},
+		{"rw admin call", func() error { _, err := alice.SetRateLimit(1, 1); return err }, codes.PermissionDenied},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.call(); status.Code(err) != tt.code {
+				t.Errorf("got %v, want %s", err, tt.code)
+			}
+		})
+	}
+
+	if err := reader.Transfer(writeLocal(t, "b.txt", []byte("no"))); err == nil {
+		t.Error("read only user uploaded")
+	}
+	if _, err := alice.Stat("a.txt"); err != nil {
+		t.Errorf("alice lost a.txt: %v", err)
+	}
+	for _, token := range []string{"", "nobody"} {
+		var opts []ClientOption
+		if token != "" {
+			opts = append(opts, WithToken(token))
+		}
+		if _, err := ts.client(t, opts...).List(""); status.Code(err) != codes.Unauthenticated {
+			t.Errorf("token %q lists with %v", token, err)
+		}
+	}
+}
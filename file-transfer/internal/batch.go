@@ -0,0 +1,44 @@
+package internal
+
+import "sync"
+
+// TransferResult is the outcome of one file of a batch upload.
+type TransferResult struct {
+	Path string
+	Name string
+	Err  error
+}
+
+// transferAll uploads files keyed by remote name over at most jobs
+// workers sharing the client connection, results keep the input order.
+func (c *grpcClient) transferAll(files []TransferResult, jobs int) []TransferResult {
+	if jobs < 1 {
+		jobs = 1
+	}
+	if err := c.initConn(); err != nil {
+		for i := range files {
+			files[i].Err = err
+		}
+		return files
+	}
+
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < jobs && w < len(files); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				files[i].Err = c.transferFile(files[i].Path, files[i].Name)
+			}
+		}()
+	}
+	for i := range files {
+		if files[i].Err == nil {
+			next <- i
+		}
+	}
+	close(next)
+	wg.Wait()
+	return files
+}
@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"strings"
+	"wangweizZZ/go-daily-study/file-transfer/internal/proto"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// max_chunk_size bounds what a single chunk may inflate to.
+const max_chunk_size int = 4 << 20
+
+// supportedCodecs are offered by the client, most preferred first.
+var supportedCodecs = []proto.Codec{proto.Codec_Zstd, proto.Codec_Gzip}
+
+// both are safe for concurrent EncodeAll and DecodeAll calls
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest))
+	zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(uint64(max_chunk_size)))
+)
+
+// ParseCodecs turns a codec name into the codecs a client offers, "auto"
+// offers every supported codec and "none" turns compression off.
+func ParseCodecs(name string) ([]proto.Codec, error) {
+	switch strings.ToLower(name) {
+	case "", "auto":
+		return supportedCodecs, nil
+	case "none":
+		return nil, nil
+	case "gzip":
+		return []proto.Codec{proto.Codec_Gzip}, nil
+	case "zstd":
+		return []proto.Codec{proto.Codec_Zstd}, nil
+	default:
+		return nil, errors.Errorf("unknown codec %q", name)
+	}
+}
+
+// negotiateCodec picks the first codec of the client the server knows.
+func negotiateCodec(offered []proto.Codec) proto.Codec {
+	for _, codec := range offered {
+		switch codec {
+		case proto.Codec_Gzip, proto.Codec_Zstd:
+			return codec
+		}
+	}
+	return proto.Codec_None
+}
+
+// encodeChunk compresses data with codec. Data that does not shrink is
+// returned as is with Codec_None, so incompressible files cost nothing
+// on the server.
+func encodeChunk(codec proto.Codec, data []byte) ([]byte, proto.Codec) {
+	var out []byte
+	switch codec {
+	case proto.Codec_Gzip:
+		var buf bytes.Buffer
+		w, _ := gzip.NewWriterLevel(&buf, gzip.BestSpeed)
+		if _, err := w.Write(data); err != nil {
+			return data, proto.Codec_None
+		}
+		if err := w.Close(); err != nil {
+			return data, proto.Codec_None
+		}
+		out = buf.Bytes()
+	case proto.Codec_Zstd:
+		out = zstdEncoder.EncodeAll(data, nil)
+	default:
+		return data, proto.Codec_None
+	}
+	if len(out) >= len(data) {
+		return data, proto.Codec_None
+	}
+	return out, codec
+}
+
+// decodeChunk reverses encodeChunk, refusing chunks that inflate beyond
+// max_chunk_size.
+func decodeChunk(codec proto.Codec, data []byte) ([]byte, error) {
+	switch codec {
+	case proto.Codec_None:
+		return data, nil
+	case proto.Codec_Gzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		out, err := ioutil.ReadAll(io.LimitReader(r, int64(max_chunk_size)+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(out) > max_chunk_size {
+			return nil, errors.Errorf("chunk inflates beyond %d bytes", max_chunk_size)
+		}
+		return out, nil
+	case proto.Codec_Zstd:
+		return zstdDecoder.DecodeAll(data, nil)
+	default:
+		return nil, errors.Errorf("unsupported codec %s", codec)
+	}
+}
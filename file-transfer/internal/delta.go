@@ -0,0 +1,303 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/md5"
+	"io"
+	"math"
+	"wangweizZZ/go-daily-study/file-transfer/internal/proto"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	min_block_size int = 4 << 10
+	max_block_size int = 1 << 20
+	// signatures are sent in batches of this many blocks
+	signature_batch int = 1024
+)
+
+// deltaBlockSize picks about sqrt(size) like rsync does, so the number
+// of signatures and the block size grow together.
+func deltaBlockSize(size int64) int {
+	n := int(math.Sqrt(float64(size)))
+	n = (n + 1023) &^ 1023
+	if n < min_block_size {
+		return min_block_size
+	}
+	if n > max_block_size {
+		return max_block_size
+	}
+	return n
+}
+
+// rollingSum is the rsync weak checksum of a window, it can slide one
+// byte at a time without looking at the whole window again.
+type rollingSum struct {
+	a, b uint32
+	n    uint32
+}
+
+func newRollingSum(p []byte) rollingSum {
+	r := rollingSum{n: uint32(len(p))}
+	for i, c := range p {
+		r.a += uint32(c)
+		r.b += uint32(len(p)-i) * uint32(c)
+	}
+	return r
+}
+
+func (r rollingSum) sum() uint32 {
+	return r.a&0xffff | r.b<<16
+}
+
+// roll drops out from the front of the window and appends in.
+func (r *rollingSum) roll(out byte, in byte) {
+	r.a += uint32(in) - uint32(out)
+	r.b += r.a - r.n*uint32(out)
+}
+
+// blockSignatures reads r block by block and hands out batches of
+// signatures.
+func blockSignatures(r io.Reader, blockSize int, send func([]*proto.BlockSignature) error) error {
+	buf := make([]byte, blockSize)
+	batch := make([]*proto.BlockSignature, 0, signature_batch)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			strong := md5.Sum(buf[:n])
+			batch = append(batch, &proto.BlockSignature{
+				Weak:   newRollingSum(buf[:n]).sum(),
+				Strong: strong[:],
+			})
+			if len(batch) == signature_batch {
+				if err := send(batch); err != nil {
+					return err
+				}
+				batch = make([]*proto.BlockSignature, 0, signature_batch)
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if len(batch) > 0 {
+		return send(batch)
+	}
+	return nil
+}
+
+// blockIndex finds the blocks of the stored version by checksum.
+type blockIndex struct {
+	blockSize int
+	blocks    []*proto.BlockSignature
+	weak      map[uint32][]int64
+}
+
+func newBlockIndex(blockSize int, blocks []*proto.BlockSignature) *blockIndex {
+	idx := &blockIndex{
+		blockSize: blockSize,
+		blocks:    blocks,
+		weak:      make(map[uint32][]int64, len(blocks)),
+	}
+	for i, b := range blocks {
+		idx.weak[b.GetWeak()] = append(idx.weak[b.GetWeak()], int64(i))
+	}
+	return idx
+}
+
+// find returns the block holding exactly p, the strong hash is only
+// computed when the weak one matches.
+func (idx *blockIndex) find(weak uint32, p []byte) (int64, bool) {
+	candidates, ok := idx.weak[weak]
+	if !ok {
+		return 0, false
+	}
+	strong := md5.Sum(p)
+	for _, i := range candidates {
+		if bytes.Equal(idx.blocks[i].GetStrong(), strong[:]) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// deltaEncoder turns a new version into copy and data ops against the
+// blocks of the stored one. Neighbouring copies are merged and literals
+// are cut at chunk_size.
+type deltaEncoder struct {
+	idx  *blockIndex
+	emit func(*proto.DeltaOp) error
+
+	pending *proto.BlockRange
+}
+
+func (e *deltaEncoder) copy(block int64) error {
+	if e.pending != nil && e.pending.Start+e.pending.Count == block {
+		e.pending.Count++
+		return nil
+	}
+	if err := e.flushCopy(); err != nil {
+		return err
+	}
+	e.pending = &proto.BlockRange{Start: block, Count: 1}
+	return nil
+}
+
+func (e *deltaEncoder) flushCopy() error {
+	if e.pending == nil {
+		return nil
+	}
+	op := &proto.DeltaOp{Op: &proto.DeltaOp_Copy{Copy: e.pending}}
+	e.pending = nil
+	return e.emit(op)
+}
+
+func (e *deltaEncoder) data(p []byte) error {
+	for len(p) > 0 {
+		if err := e.flushCopy(); err != nil {
+			return err
+		}
+		n := len(p)
+		if n > chunk_size {
+			n = chunk_size
+		}
+		//the op is sent before the buffer is reused, but copy to be safe
+		content := append([]byte(nil), p[:n]...)
+		if err := e.emit(&proto.DeltaOp{Op: &proto.DeltaOp_Data{Data: content}}); err != nil {
+			return err
+		}
+		p = p[n:]
+	}
+	return nil
+}
+
+// encode slides a window of one block over r, emitting a copy whenever
+// the window matches a stored block and literal data for everything in
+// between.
+func (e *deltaEncoder) encode(r io.Reader) error {
+	blockSize := e.idx.blockSize
+	buf := make([]byte, 0, 8*blockSize)
+	var (
+		start, lit int
+		eof        bool
+		sum        rollingSum
+		valid      bool
+	)
+	for {
+		//keep a whole window in the buffer while the input lasts
+		if len(buf)-start < blockSize && !eof {
+			if err := e.data(buf[lit:start]); err != nil {
+				return err
+			}
+			n := copy(buf[:cap(buf)], buf[start:])
+			buf, start, lit = buf[:n], 0, 0
+			for len(buf) < cap(buf) && !eof {
+				m, err := r.Read(buf[len(buf):cap(buf)])
+				buf = buf[:len(buf)+m]
+				if err == io.EOF {
+					eof = true
+				} else if err != nil {
+					return err
+				}
+			}
+		}
+
+		n := len(buf) - start
+		if n < blockSize {
+			//only the tail is left, it can match the short last block
+			tail := buf[start:]
+			if block, ok := e.idx.find(newRollingSum(tail).sum(), tail); n > 0 && ok {
+				if err := e.data(buf[lit:start]); err != nil {
+					return err
+				}
+				if err := e.copy(block); err != nil {
+					return err
+				}
+				lit = len(buf)
+			}
+			break
+		}
+		n = blockSize
+		window := buf[start : start+n]
+		if !valid {
+			sum, valid = newRollingSum(window), true
+		}
+		if block, ok := e.idx.find(sum.sum(), window); ok {
+			if err := e.data(buf[lit:start]); err != nil {
+				return err
+			}
+			if err := e.copy(block); err != nil {
+				return err
+			}
+			start += n
+			lit, valid = start, false
+			continue
+		}
+
+		if start+n < len(buf) {
+			sum.roll(buf[start], buf[start+n])
+		} else {
+			valid = false
+		}
+		start++
+		if start-lit >= chunk_size {
+			if err := e.data(buf[lit:start]); err != nil {
+				return err
+			}
+			lit = start
+		}
+	}
+	if err := e.data(buf[lit:]); err != nil {
+		return err
+	}
+	return e.flushCopy()
+}
+
+// deltaPatcher rebuilds a new version from the stored one and the ops
+// of a delta, refusing to write beyond the declared size.
+type deltaPatcher struct {
+	base      io.ReaderAt
+	baseSize  int64
+	blockSize int64
+	out       io.Writer
+	written   int64
+	size      int64
+}
+
+func (p *deltaPatcher) apply(op *proto.DeltaOp) error {
+	switch v := op.GetOp().(type) {
+	case *proto.DeltaOp_Copy:
+		//checked in blocks before multiplying, so huge counts can not overflow
+		first, count := v.Copy.GetStart(), v.Copy.GetCount()
+		blocks := (p.baseSize + p.blockSize - 1) / p.blockSize
+		if first < 0 || count <= 0 || first >= blocks || count > blocks-first {
+			return errors.Errorf("copy of blocks [%d, +%d) is outside the stored file", first, count)
+		}
+		start := first * p.blockSize
+		n := count * p.blockSize
+		//the last block may be short
+		if start+n > p.baseSize {
+			n = p.baseSize - start
+		}
+		return p.write(io.NewSectionReader(p.base, start, n), n)
+	case *proto.DeltaOp_Data:
+		return p.write(bytes.NewReader(v.Data), int64(len(v.Data)))
+	default:
+		return errors.Errorf("unexpected delta op %T", v)
+	}
+}
+
+func (p *deltaPatcher) write(r io.Reader, n int64) error {
+	if p.written+n > p.size {
+		return errors.Errorf("delta grows beyond the declared size %d", p.size)
+	}
+	if _, err := io.CopyN(p.out, r, n); err != nil {
+		return err
+	}
+	p.written += n
+	return nil
+}
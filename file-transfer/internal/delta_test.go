@@ -0,0 +1,235 @@
+package internal
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"testing"
+	"wangweizZZ/go-daily-study/file-transfer/internal/proto"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const test_block_size int = 64
+
+func randomBytes(seed int64, n int) []byte {
+	p := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(p)
+	return p
+}
+
+// roundTrip encodes next against the blocks of base and patches base
+// with the result, it returns what the patch wrote and the literal bytes
+// of the delta.
+func roundTrip(t *testing.T, base []byte, next []byte) ([]byte, int) {
+	t.Helper()
+	var blocks []*proto.BlockSignature
+	err := blockSignatures(bytes.NewReader(base), test_block_size, func(batch []*proto.BlockSignature) error {
+		blocks = append(blocks, batch...)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	patcher := &deltaPatcher{
+		base:      bytes.NewReader(base),
+		baseSize:  int64(len(base)),
+		blockSize: int64(test_block_size),
+		out:       &out,
+		size:      int64(len(next)),
+	}
+	var literal int
+	enc := &deltaEncoder{
+		idx: newBlockIndex(test_block_size, blocks),
+		emit: func(op *proto.DeltaOp) error {
+			literal += len(op.GetData())
+			return patcher.apply(op)
+		},
+	}
+	if err = enc.encode(bytes.NewReader(next)); err != nil {
+		t.Fatal(err)
+	}
+	if patcher.written != int64(len(next)) {
+		t.Fatalf("patch wrote %d bytes, want %d", patcher.written, len(next))
+	}
+	return out.Bytes(), literal
+}
+
+func TestDeltaRoundTrip(t *testing.T) {
+	base := randomBytes(1, 50*test_block_size)
+	edited := append([]byte(nil), base...)
+	copy(edited[10*test_block_size+5:], "edited in place")
+	copy(edited[30*test_block_size:], "and again")
+	inserted := append(append(append([]byte(nil), base[:777]...), "inserted bytes"...), base[777:]...)
+	removed := append(append([]byte(nil), base[:1000]...), base[1003:]...)
+	short := append([]byte(nil), base[:20*test_block_size+17]...)
+	appended := append(append([]byte(nil), base...), "appended tail"...)
+	tailOnly := append([]byte(nil), base[len(base)-test_block_size:]...)
+
+	tests := []struct {
+		name       string
+		base, next []byte
+		// maxLiteral bounds the literal bytes of the delta
+		maxLiteral int
+	}{
+		{"unchanged", base, base, 0},
+		{"in place edits", base, edited, 2 * test_block_size},
+		{"insert shifts alignment", base, inserted, test_block_size + len("inserted bytes")},
+		{"removal shifts alignment", base, removed, test_block_size},
+		{"short last block matches", short, short, 0},
+		{"short last block dropped", base, short, 17},
+		{"appended", base, appended, len("appended tail")},
+		{"one block", base, tailOnly, 0},
+		{"empty base", nil, base, len(base)},
+		{"empty new", base, nil, 0},
+		{"both empty", nil, nil, 0},
+		{"new shorter than a block", base, base[:10], 10},
+		{"unrelated", base, randomBytes(2, 10*test_block_size), 10 * test_block_size},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, literal := roundTrip(t, tt.base, tt.next)
+			if !bytes.Equal(got, tt.next) {
+				t.Fatalf("patched %d bytes differ from the %d new ones", len(got), len(tt.next))
+			}
+			if literal > tt.maxLiteral {
+				t.Errorf("delta sent %d literal bytes, want at most %d", literal, tt.maxLiteral)
+			}
+		})
+	}
+}
+
+func TestDeltaMergesCopies(t *testing.T) {
+	base := randomBytes(3, 10*test_block_size+3)
+	var blocks []*proto.BlockSignature
+	blockSignatures(bytes.NewReader(base), test_block_size, func(batch []*proto.BlockSignature) error {
+		blocks = append(blocks, batch...)
+		return nil
+	})
+	var ops []*proto.DeltaOp
+	enc := &deltaEncoder{
+		idx:  newBlockIndex(test_block_size, blocks),
+		emit: func(op *proto.DeltaOp) error { ops = append(ops, op); return nil },
+	}
+	if err := enc.encode(bytes.NewReader(base)); err != nil {
+		t.Fatal(err)
+	}
+	if len(ops) != 1 || ops[0].GetCopy().GetStart() != 0 || ops[0].GetCopy().GetCount() != 11 {
+		t.Fatalf("got ops %v, want one copy of all 11 blocks", ops)
+	}
+}
+
+func TestDeltaPatcherRejects(t *testing.T) {
+	base := randomBytes(4, 4*test_block_size)
+	tests := []struct {
+		name string
+		op   *proto.DeltaOp
+		size int64
+	}{
+		{"copy past the end", &proto.DeltaOp{Op: &proto.DeltaOp_Copy{Copy: &proto.BlockRange{Start: 4, Count: 1}}}, 1 << 20},
+		{"copy running past the end", &proto.DeltaOp{Op: &proto.DeltaOp_Copy{Copy: &proto.BlockRange{Start: 1, Count: 4}}}, 1 << 20},
+		{"count overflowing", &proto.DeltaOp{Op: &proto.DeltaOp_Copy{Copy: &proto.BlockRange{Start: 0, Count: math.MaxInt64/int64(test_block_size) + 2}}}, 1 << 20},
+		{"largest count", &proto.DeltaOp{Op: &proto.DeltaOp_Copy{Copy: &proto.BlockRange{Start: 1, Count: math.MaxInt64}}}, 1 << 20},
+		{"start overflowing", &proto.DeltaOp{Op: &proto.DeltaOp_Copy{Copy: &proto.BlockRange{Start: math.MaxInt64/int64(test_block_size) + 2, Count: 1}}}, 1 << 20},
+		{"negative copy", &proto.DeltaOp{Op: &proto.DeltaOp_Copy{Copy: &proto.BlockRange{Start: -1, Count: 1}}}, 1 << 20},
+		{"empty copy", &proto.DeltaOp{Op: &proto.DeltaOp_Copy{Copy: &proto.BlockRange{Start: 0, Count: 0}}}, 1 << 20},
+		{"copy beyond size", &proto.DeltaOp{Op: &proto.DeltaOp_Copy{Copy: &proto.BlockRange{Start: 0, Count: 2}}}, int64(test_block_size)},
+		{"data beyond size", &proto.DeltaOp{Op: &proto.DeltaOp_Data{Data: []byte("12345")}}, 4},
+		{"no op", &proto.DeltaOp{}, 1 << 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			p := &deltaPatcher{
+				base:      bytes.NewReader(base),
+				baseSize:  int64(len(base)),
+				blockSize: int64(test_block_size),
+				out:       &out,
+				size:      tt.size,
+			}
+			if err := p.apply(tt.op); err == nil {
+				t.Fatal("op was applied")
+			}
+			if out.Len() != 0 || p.written != 0 {
+				t.Errorf("wrote %d bytes", out.Len())
+			}
+		})
+	}
+}
+
+func TestDeltaPatcherClipsLastBlock(t *testing.T) {
+	base := randomBytes(5, 2*test_block_size+9)
+	var out bytes.Buffer
+	p := &deltaPatcher{
+		base:      bytes.NewReader(base),
+		baseSize:  int64(len(base)),
+		blockSize: int64(test_block_size),
+		out:       &out,
+		size:      int64(len(base)),
+	}
+	if err := p.apply(&proto.DeltaOp{Op: &proto.DeltaOp_Copy{Copy: &proto.BlockRange{Start: 1, Count: 2}}}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), base[test_block_size:]) {
+		t.Errorf("copied %d bytes, want the %d from block 1 on", out.Len(), len(base)-test_block_size)
+	}
+}
+
+func TestRollingSum(t *testing.T) {
+	data := randomBytes(6, 1000)
+	sum := newRollingSum(data[:test_block_size])
+	for i := 1; i+test_block_size <= len(data); i++ {
+		sum.roll(data[i-1], data[i-1+test_block_size])
+		if want := newRollingSum(data[i : i+test_block_size]); sum.sum() != want.sum() {
+			t.Fatalf("rolled sum at %d is %x, want %x", i, sum.sum(), want.sum())
+		}
+	}
+}
+
+func TestDeltaBlockSize(t *testing.T) {
+	tests := []struct {
+		size int64
+		want int
+	}{
+		{0, min_block_size},
+		{1 << 20, min_block_size},
+		{1 << 30, 32 << 10},
+		{1 << 50, max_block_size},
+	}
+	for _, tt := range tests {
+		if got := deltaBlockSize(tt.size); got != tt.want {
+			t.Errorf("deltaBlockSize(%d) = %d, want %d", tt.size, got, tt.want)
+		}
+	}
+}
+
+func TestDeltaUpload(t *testing.T) {
+	ts := startTestServer(t)
+	base := randomBytes(7, 300<<10)
+	path := writeLocal(t, "a.bin", base)
+	if err := ts.client(t).Transfer(path); err != nil {
+		t.Fatal(err)
+	}
+	next := append(append([]byte(nil), base[:100<<10]...), randomBytes(8, 50<<10)...)
+	next = append(next, base[150<<10:]...)
+	if err := ioutil.WriteFile(path, next, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.client(t, WithDelta(true)).Transfer(path); err != nil {
+		t.Fatal(err)
+	}
+	if received := testutil.ToFloat64(ts.metrics.receivedBytes) - float64(len(base)); received > float64(len(next)/2) {
+		t.Errorf("the patch sent %.0f of %d bytes", received, len(next))
+	}
+	got, err := ioutil.ReadFile(filepath.Join(ts.store, "a.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, next) {
+		t.Fatalf("stored %d bytes differ from the %d patched ones", len(got), len(next))
+	}
+}
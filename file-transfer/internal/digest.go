@@ -0,0 +1,79 @@
+package internal
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"os"
+	"strings"
+	"wangweizZZ/go-daily-study/file-transfer/internal/proto"
+
+	"github.com/pkg/errors"
+)
+
+// negotiateDigest returns the digest type the server will verify,
+// falling back to md5 for anything it does not know.
+func negotiateDigest(want proto.DigestType) proto.DigestType {
+	switch want {
+	case proto.DigestType_Md5, proto.DigestType_Sha256:
+		return want
+	default:
+		return proto.DigestType_Md5
+	}
+}
+
+// ParseDigest turns a digest name into the digest type a client asks the
+// server to verify.
+func ParseDigest(name string) (proto.DigestType, error) {
+	switch strings.ToLower(name) {
+	case "", "sha256":
+		return proto.DigestType_Sha256, nil
+	case "md5":
+		return proto.DigestType_Md5, nil
+	default:
+		return 0, errors.Errorf("unknown digest %q", name)
+	}
+}
+
+func newDigest(t proto.DigestType) (hash.Hash, error) {
+	switch t {
+	case proto.DigestType_Md5:
+		return md5.New(), nil
+	case proto.DigestType_Sha256:
+		return sha256.New(), nil
+	default:
+		return nil, errors.Errorf("unsupported digest type %s", t)
+	}
+}
+
+func sumHex(h hash.Hash) string {
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// digestPrefix feeds the first n bytes of r into h.
+func digestPrefix(h hash.Hash, r io.ReaderAt, n int64) error {
+	if n == 0 {
+		return nil
+	}
+	_, err := io.Copy(h, io.NewSectionReader(r, 0, n))
+	return err
+}
+
+// fileDigest returns the hex digest of the file at path.
+func fileDigest(path string, t proto.DigestType) (string, error) {
+	h, err := newDigest(t)
+	if err != nil {
+		return "", err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	if _, err = io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return sumHex(h), nil
+}
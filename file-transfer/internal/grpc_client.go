@@ -2,15 +2,22 @@ package internal
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
 	"io"
-	"log"
 	"os"
+	"path/filepath"
+	"sync"
 	"time"
 	"wangweizZZ/go-daily-study/file-transfer/internal/proto"
 
 	"github.com/pkg/errors"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
 )
 
 var _ Client = &grpcClient{}
@@ -20,14 +27,29 @@ type grpcClientOption func(*grpcClient)
 type grpcClient struct {
 	config      *clientConfig
 	address     string
+	connMu      sync.Mutex
 	conn        *grpc.ClientConn
 	innerClient proto.TransferServiceClient
+	limiter     *limiter
+	log         *Logger
 }
 
 type clientConfig struct {
 	tls                bool
 	caFile             string
 	serverHostOverride string
+	certFile           string
+	keyFile            string
+	token              string
+	limitRate          int64
+	codecs             []proto.Codec
+	digest             proto.DigestType
+	progress           func(Progress)
+	jobs               int
+	parallel           int
+	delta              bool
+	retry              RetryPolicy
+	logger             *Logger
 }
 
 type ClientOption func(*clientConfig)
@@ -40,9 +62,97 @@ func WithClientTls(caFile string, serverHostOverride string) ClientOption {
 	}
 }
 
+// WithClientCert presents the certificate in certFile to servers that
+// require client authentication.
+func WithClientCert(certFile string, keyFile string) ClientOption {
+	return func(cc *clientConfig) {
+		cc.certFile = certFile
+		cc.keyFile = keyFile
+	}
+}
+
+// WithToken authenticates every call with a bearer token.
+func WithToken(token string) ClientOption {
+	return func(cc *clientConfig) {
+		cc.token = token
+	}
+}
+
+// WithLimitRate paces uploads to rate bytes per second across all of
+// their streams.
+func WithLimitRate(rate int64) ClientOption {
+	return func(cc *clientConfig) {
+		cc.limitRate = rate
+	}
+}
+
+// WithCodecs offers codecs to the server for compressing uploads, most
+// preferred first. No codecs turns compression off.
+func WithCodecs(codecs ...proto.Codec) ClientOption {
+	return func(cc *clientConfig) {
+		cc.codecs = codecs
+	}
+}
+
+// WithDigest has uploads verified with digest instead of sha256.
+func WithDigest(digest proto.DigestType) ClientOption {
+	return func(cc *clientConfig) {
+		cc.digest = digest
+	}
+}
+
+// WithProgress calls report as uploads advance, streams of a parallel
+// upload call it concurrently but never at the same time.
+func WithProgress(report func(Progress)) ClientOption {
+	return func(cc *clientConfig) {
+		cc.progress = report
+	}
+}
+
+// WithJobs uploads up to n files of a batch or directory at once.
+func WithJobs(n int) ClientOption {
+	return func(cc *clientConfig) {
+		cc.jobs = n
+	}
+}
+
+// WithParallel uploads each file over n concurrent Write streams.
+func WithParallel(n int) ClientOption {
+	return func(cc *clientConfig) {
+		cc.parallel = n
+	}
+}
+
+// WithDelta sends only the blocks that changed when the server already
+// has a version of a file.
+func WithDelta(delta bool) ClientOption {
+	return func(cc *clientConfig) {
+		cc.delta = delta
+	}
+}
+
+// WithRetry retries uploads that fail on a dropped connection or another
+// transient error according to policy.
+func WithRetry(policy RetryPolicy) ClientOption {
+	return func(cc *clientConfig) {
+		cc.retry = policy
+	}
+}
+
+// WithClientLogger writes the log of the client to logger instead of
+// stderr.
+func WithClientLogger(logger *Logger) ClientOption {
+	return func(cc *clientConfig) {
+		cc.logger = logger
+	}
+}
+
 func NewClientConfig(opts ...ClientOption) *clientConfig {
 	clientConfig := &clientConfig{
-		tls: false,
+		tls:    false,
+		codecs: supportedCodecs,
+		digest: proto.DigestType_Sha256,
+		retry:  DefaultRetryPolicy,
 	}
 	for _, opt := range opts {
 		opt(clientConfig)
@@ -51,16 +161,89 @@ func NewClientConfig(opts ...ClientOption) *clientConfig {
 }
 
 //default tls is false
-var DefaultClientConfig *clientConfig = &clientConfig{tls: false}
+var DefaultClientConfig *clientConfig = &clientConfig{tls: false, codecs: supportedCodecs, digest: proto.DigestType_Sha256, retry: DefaultRetryPolicy}
 
 func NewGrpcClient(add string, config *clientConfig) *grpcClient {
+	logger := config.logger
+	if logger == nil {
+		logger = defaultLogger
+	}
 	return &grpcClient{
 		config:  config,
 		address: add,
+		limiter: newLimiter(config.limitRate),
+		log:     logger,
 	}
 }
 
 func (c *grpcClient) Transfer(filePath string) error {
+	//init connection
+	if err := c.initConn(); err != nil {
+		return err
+	}
+
+	return c.transferFile(filePath, GetName(filePath))
+}
+
+// TransferDir uploads the files below dir that the server does not hold
+// yet, keeping their paths relative to dir.
+func (c *grpcClient) TransferDir(dir string, include []string, exclude []string) error {
+	entries, paths, err := buildManifest(dir, include, exclude, c.config.digest)
+	if err != nil {
+		return err
+	}
+
+	if err = c.initConn(); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	result, err := c.innerClient.Manifest(ctx, &proto.ManifestRequest{
+		Entries:    entries,
+		DigestType: c.config.digest,
+	})
+	if err != nil {
+		return err
+	}
+
+	c.log.Info("compared directory", "dir", dir, "files", len(entries), "missing", len(result.GetMissing()))
+	files := make([]TransferResult, 0, len(result.GetMissing()))
+	for _, name := range result.GetMissing() {
+		path, ok := paths[name]
+		if !ok {
+			return errors.Errorf("server asked for unknown file %s", name)
+		}
+		files = append(files, TransferResult{Path: path, Name: name})
+	}
+	for _, r := range c.transferAll(files, c.config.jobs) {
+		if r.Err != nil {
+			return errors.Wrapf(r.Err, "transfer %s", r.Name)
+		}
+	}
+	return nil
+}
+
+// TransferFiles uploads every path under its base name over one
+// connection. Paths sharing a base name are refused instead of
+// overwriting each other.
+func (c *grpcClient) TransferFiles(paths []string) []TransferResult {
+	files := make([]TransferResult, len(paths))
+	seen := make(map[string]string)
+	for i, path := range paths {
+		name := GetName(path)
+		files[i] = TransferResult{Path: path, Name: name}
+		if other, ok := seen[name]; ok {
+			files[i].Err = errors.Errorf("%s has the same name as %s", path, other)
+			continue
+		}
+		seen[name] = path
+	}
+	return c.transferAll(files, c.config.jobs)
+}
+
+// transferFile uploads the local file at filePath as name.
+func (c *grpcClient) transferFile(filePath string, name string) error {
 	fsize, err := Size(filePath)
 	if err != nil {
 		return err
@@ -73,112 +256,616 @@ func (c *grpcClient) Transfer(filePath string) error {
 	}
 	defer file.Close()
 
-	//init connection
-	c.initConn()
-	defer c.Close()
-
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	ctx, cancel := context.WithTimeout(context.Background(), c.config.retry.Deadline)
 	defer cancel()
-	//
-	fir, err := c.doOpen(ctx, file.Name(), true)
+	log := c.log.With("file", name, "path", filePath)
+	if c.config.delta {
+		var done bool
+		err := c.retry(ctx, log, func() (err error) {
+			done, err = c.transferDelta(ctx, log, file, name, fsize)
+			return err
+		})
+		switch {
+		case done && err == nil:
+			return nil
+		case err != nil && transient(err):
+			//out of attempts, the whole file would not get through either
+			return err
+		case err != nil:
+			log.Warn("delta failed, sending the whole file", "error", err)
+		}
+	}
+	return c.retry(ctx, log, func() error {
+		return c.uploadOnce(ctx, log, file, name, fsize)
+	})
+}
+
+// transferReader uploads the first size bytes of r as name, resuming and
+// retrying like transferFile does. Calls carry the metadata of ctx.
+func (c *grpcClient) transferReader(ctx context.Context, r io.ReaderAt, name string, size int64) error {
+	if err := c.initConn(); err != nil {
+		return err
+	}
+	log := c.log.With("file", name)
+	return c.retry(ctx, log, func() error {
+		return c.uploadOnce(ctx, log, r, name, size)
+	})
+}
+
+// uploadOnce opens the upload of name, resumes it from what the server
+// already has and sends the rest of file.
+func (c *grpcClient) uploadOnce(ctx context.Context, log *Logger, file io.ReaderAt, name string, fsize int64) error {
+	fir, err := c.doOpen(ctx, name, fsize, true)
 	if err != nil {
 		return err
 	}
-	var offset int64 = 0
-	if fir.GetOffset() != 0 {
-		if fir.GetOffset() > fsize {
-			return errors.New("seek offset is too big")
-		} else if fir.GetOffset() == fsize {
-			return nil
+	log = log.With("session", fir.GetId())
+	log.Info("upload opened", "offset", fir.GetOffset(), "size", fsize, "codec", fir.GetCodec())
+	digest, err := newDigest(fir.GetDigestType())
+	if err != nil {
+		return err
+	}
+	if fir.GetOffset() > fsize {
+		return errors.New("seek offset is too big")
+	}
+	progress := newProgressTracker(name, fsize, fir.GetOffset(), c.config.progress)
+	if c.config.parallel > 1 {
+		return c.transferParallel(ctx, log, file, digest, fir, fsize, progress)
+	}
+
+	offset := fir.GetOffset()
+	//the server checks the whole file, including what it already has
+	if err = digestPrefix(digest, file, offset); err != nil {
+		return err
+	}
+	r := io.NewSectionReader(file, offset, fsize-offset)
+	result, err := c.doTransfer(ctx, log, progress.reader(io.TeeReader(r, digest)), fir.GetId(), fir.GetCodec(), offset, func() string {
+		return sumHex(digest)
+	})
+	if err != nil {
+		return err
+	}
+	switch result.Code {
+	case proto.ResultCode_Ok:
+		return nil
+	case proto.ResultCode_Unknown:
+		if result.Offset > fsize {
+			return errors.New("file size wrong!" + result.Message)
 		}
+		return errIncomplete
+	default:
+		return errors.New("fail:" + result.Message)
+	}
+}
 
-		offset, err = file.Seek(fir.GetOffset(), 0)
+// transferDelta patches the stored version of name into file, sending
+// only the blocks the server does not have. It reports false when there
+// is no stored version to start from.
+func (c *grpcClient) transferDelta(ctx context.Context, log *Logger, file *os.File, name string, fsize int64) (bool, error) {
+	sigs, err := c.innerClient.Signatures(ctx, &proto.SignatureRequest{Name: name})
+	if err != nil {
+		return false, err
+	}
+	var (
+		header *proto.SignatureBatch
+		blocks []*proto.BlockSignature
+	)
+	for {
+		batch, err := sigs.Recv()
+		if err == io.EOF {
+			break
+		}
+		if status.Code(err) == codes.NotFound {
+			return false, nil
+		}
 		if err != nil {
+			return false, err
+		}
+		if header == nil {
+			header = batch
+		}
+		blocks = append(blocks, batch.GetBlocks()...)
+	}
+	if header == nil || header.GetBlockSize() <= 0 {
+		return false, errors.New("server sent no block size")
+	}
+
+	stream, err := c.innerClient.Patch(ctx)
+	if err != nil {
+		return false, err
+	}
+	err = stream.Send(&proto.DeltaOp{Op: &proto.DeltaOp_Header{Header: &proto.DeltaHeader{
+		Name:        name,
+		Size:        fsize,
+		DigestType:  c.config.digest,
+		BlockSize:   header.GetBlockSize(),
+		BaseSize:    header.GetSize(),
+		BaseModTime: header.GetModTime(),
+	}}})
+	if err != nil {
+		return false, err
+	}
+
+	var literal int64
+	digest, _ := newDigest(c.config.digest)
+	progress := newProgressTracker(name, fsize, 0, c.config.progress)
+	enc := &deltaEncoder{
+		idx: newBlockIndex(int(header.GetBlockSize()), blocks),
+		emit: func(op *proto.DeltaOp) error {
+			if data := op.GetData(); data != nil {
+				if err := c.limiter.wait(ctx, len(data)); err != nil {
+					return err
+				}
+				literal += int64(len(data))
+			}
+			log.Debug("delta op", "copy", op.GetCopy() != nil, "data", len(op.GetData()))
+			return stream.Send(op)
+		},
+	}
+	//from the start again on every attempt
+	content := io.NewSectionReader(file, 0, fsize)
+	if err = enc.encode(progress.reader(io.TeeReader(content, digest))); err != nil {
+		return false, err
+	}
+	if err = stream.Send(&proto.DeltaOp{Op: &proto.DeltaOp_Digest{Digest: sumHex(digest)}}); err != nil {
+		return false, err
+	}
+	result, err := stream.CloseAndRecv()
+	if err != nil {
+		return false, err
+	}
+	if result.GetCode() != proto.ResultCode_Ok {
+		return false, errors.New("fail:" + result.GetMessage())
+	}
+	log.Info("upload patched", "size", fsize, "literal", literal)
+	return true, nil
+}
+
+// transferParallel uploads [offset, fsize) of file over several Write
+// streams at once, the server commits when the last range arrives.
+func (c *grpcClient) transferParallel(ctx context.Context, log *Logger, file io.ReaderAt, digest hash.Hash, fir *proto.FileInfoResult, fsize int64, progress *progressTracker) error {
+	//every stream carries the digest, so it has to be known up front
+	if _, err := io.Copy(digest, io.NewSectionReader(file, 0, fsize)); err != nil {
+		return err
+	}
+	sum := sumHex(digest)
+
+	ranges := splitRange(fir.GetOffset(), fsize, c.config.parallel)
+	results := make([]*proto.ChunkResult, len(ranges))
+	errs := make([]error, len(ranges))
+	var wg sync.WaitGroup
+	for i, r := range ranges {
+		wg.Add(1)
+		go func(i int, r byteRange) {
+			defer wg.Done()
+			results[i], errs[i] = c.doTransfer(ctx, log, progress.reader(io.NewSectionReader(file, r.Start, r.End-r.Start)), fir.GetId(), fir.GetCodec(), r.Start, func() string {
+				return sum
+			})
+		}(i, r)
+	}
+	wg.Wait()
+
+	committed := false
+	for i := range ranges {
+		if errs[i] != nil {
+			return errs[i]
+		}
+		switch results[i].Code {
+		case proto.ResultCode_Ok:
+			committed = true
+		case proto.ResultCode_Failed:
+			return errors.New("fail:" + results[i].Message)
+		}
+	}
+	if !committed {
+		return errIncomplete
+	}
+	return nil
+}
+
+func (c *grpcClient) Download(remote string, local string) error {
+	return c.download(remote, local, func(ctx context.Context, offset int64) (chunkReceiver, error) {
+		return c.innerClient.Read(ctx, &proto.FileRequest{Name: remote, Offset: offset})
+	})
+}
+
+// DownloadShared downloads the file of a share link to local. The token
+// does not tell the name of the file, so without local it is written
+// aside and named after the chunks once it is complete.
+func (c *grpcClient) DownloadShared(token string, local string) (string, error) {
+	path := local
+	if path == "" {
+		sum := sha256.Sum256([]byte(token))
+		path = "share-" + hex.EncodeToString(sum[:8])
+	}
+	var name string
+	err := c.download("shared file", path, func(ctx context.Context, offset int64) (chunkReceiver, error) {
+		stream, err := c.innerClient.ReadShared(ctx, &proto.SharedFileRequest{Token: token, Offset: offset})
+		if err != nil {
+			return nil, err
+		}
+		return &namedReceiver{chunkReceiver: stream, name: &name}, nil
+	})
+	if err != nil || local != "" {
+		return path, err
+	}
+	local = filepath.Base(filepath.FromSlash(name))
+	if name == "" || local == "." || local == ".." || local == string(filepath.Separator) {
+		return path, errors.Errorf("the server named the shared file %q, it is kept as %s", name, path)
+	}
+	return local, os.Rename(path, local)
+}
+
+// namedReceiver notes the file name the chunks of a stream carry.
+type namedReceiver struct {
+	chunkReceiver
+	name *string
+}
+
+func (r *namedReceiver) Recv() (*proto.Chunk, error) {
+	chunk, err := r.chunkReceiver.Recv()
+	if err == nil && chunk.GetId() != "" {
+		*r.name = chunk.GetId()
+	}
+	return chunk, err
+}
+
+// chunkReceiver is a client stream of chunks, such as Read's.
+type chunkReceiver interface {
+	Recv() (*proto.Chunk, error)
+}
+
+// download writes the chunks of the stream open returns to local,
+// resuming from what an earlier try left on disk and retrying like
+// transferFile does. The file is only renamed to local once it matches
+// the digest the server sent.
+func (c *grpcClient) download(name string, local string, open func(ctx context.Context, offset int64) (chunkReceiver, error)) error {
+	if err := c.initConn(); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.config.retry.Deadline)
+	defer cancel()
+	log := c.log.With("file", name, "path", local)
+	tmpPath := local + tmp_file_suffix
+	err := c.retry(ctx, log, func() error {
+		return c.downloadOnce(ctx, log, tmpPath, open)
+	})
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, local)
+}
+
+// downloadOnce appends the rest of the file to tmpPath. When the result
+// does not match the server, what was there before it is dropped and
+// errChanged returned.
+func (c *grpcClient) downloadOnce(ctx context.Context, log *Logger, tmpPath string, open func(ctx context.Context, offset int64) (chunkReceiver, error)) error {
+	localFile, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	defer localFile.Close()
+
+	//resume from what is already on disk
+	offset, err := localFile.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	resumed := offset
+	digest, _ := newDigest(proto.DigestType_Sha256)
+	if err = digestPrefix(digest, localFile, offset); err != nil {
+		return err
+	}
+	//the next attempt downloads the whole file again
+	restart := func() error {
+		if err := localFile.Truncate(0); err != nil {
 			return err
 		}
+		return errChanged
 	}
 
+	stream, err := open(ctx, offset)
+	if err != nil {
+		return err
+	}
+	log.Info("download started", "offset", offset)
+	var expected string
 	for {
-		status, err := c.doTransfer(ctx, file, fir.GetId(), offset)
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
+			if resumed > 0 && status.Code(err) == codes.InvalidArgument {
+				log.Warn("partial download is longer than the file, starting over", "offset", resumed)
+				return restart()
+			}
 			return err
 		}
-		switch status.Code {
-		case proto.ResultCode_Ok:
+		if chunk.GetOffset() != offset {
+			return errors.Errorf("unexpected chunk offset %d, want %d", chunk.GetOffset(), offset)
+		}
+		if _, err = localFile.Write(chunk.GetContent()); err != nil {
+			return err
+		}
+		digest.Write(chunk.GetContent())
+		offset += int64(len(chunk.GetContent()))
+		if chunk.GetDigest() != "" {
+			expected = chunk.GetDigest()
+		}
+	}
+
+	//servers before the digest of reads send none
+	if actual := sumHex(digest); expected != "" && actual != expected {
+		if resumed > 0 {
+			log.Warn("download does not match the server, starting over", "offset", resumed)
+			return restart()
+		}
+		return errors.Errorf("sha256 mismatch: expected %s, got %s", expected, actual)
+	}
+	return localFile.Close()
+}
+
+// List returns every file on the server whose name starts with prefix.
+func (c *grpcClient) List(prefix string) ([]*proto.FileStat, error) {
+	if err := c.initConn(); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	var files []*proto.FileStat
+	req := &proto.ListRequest{Prefix: prefix}
+	for {
+		result, err := c.innerClient.List(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, result.GetFiles()...)
+		if result.GetNextPageToken() == "" {
+			return files, nil
+		}
+		req.PageToken = result.GetNextPageToken()
+	}
+}
+
+func (c *grpcClient) Stat(name string) (*proto.FileStat, error) {
+	if err := c.initConn(); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	return c.innerClient.Stat(ctx, &proto.StatRequest{Name: name})
+}
+
+func (c *grpcClient) Delete(name string) error {
+	if err := c.initConn(); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	_, err := c.innerClient.Delete(ctx, &proto.DeleteRequest{Name: name})
+	return err
+}
+
+func (c *grpcClient) Rename(from string, to string) error {
+	if err := c.initConn(); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	_, err := c.innerClient.Rename(ctx, &proto.RenameRequest{From: from, To: to})
+	return err
+}
+
+// Share issues a link to name that works for ttl, 0 leaves it to the
+// server, and for maxDownloads downloads, 0 for no limit.
+func (c *grpcClient) Share(name string, ttl time.Duration, maxDownloads int32) (*proto.ShareLink, error) {
+	if err := c.initConn(); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	return c.innerClient.Share(ctx, &proto.ShareRequest{
+		Name:         name,
+		TtlSeconds:   int64(ttl / time.Second),
+		MaxDownloads: maxDownloads,
+	})
+}
+
+// RevokeShare stops the share link with the id or token from working.
+func (c *grpcClient) RevokeShare(id string) error {
+	if err := c.initConn(); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	_, err := c.innerClient.RevokeShare(ctx, &proto.RevokeShareRequest{Id: id})
+	return err
+}
+
+// Replication reports how far behind every replication peer of the
+// server is.
+func (c *grpcClient) Replication() (*proto.ReplicationStatus, error) {
+	if err := c.initConn(); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	return c.innerClient.Replication(ctx, &emptypb.Empty{})
+}
+
+// SetRateLimit changes the upload limits of the server, negative values
+// keep the current limit.
+func (c *grpcClient) SetRateLimit(global int64, perClient int64) (*proto.RateLimit, error) {
+	if err := c.initConn(); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	return c.innerClient.SetRateLimit(ctx, &proto.RateLimit{Global: global, PerClient: perClient})
+}
+
+// WatchTransfers hands every progress snapshot of the server to fn
+// until fn fails or the server goes away.
+func (c *grpcClient) WatchTransfers(interval time.Duration, fn func(*proto.TransferSnapshot) error) error {
+	if err := c.initConn(); err != nil {
+		return err
+	}
+
+	stream, err := c.innerClient.WatchTransfers(context.Background(), &proto.WatchRequest{
+		IntervalMs: int32(interval / time.Millisecond),
+	})
+	if err != nil {
+		return err
+	}
+	for {
+		snapshot, err := stream.Recv()
+		if err == io.EOF {
 			return nil
-		case proto.ResultCode_Unknown:
-			if fsize == status.Offset {
-				return nil
-			} else if fsize < status.Offset {
-				return errors.New("file size wrong!" + status.Message)
-			}
-		default:
-			return errors.New("fail:" + status.Message)
+		}
+		if err != nil {
+			return err
+		}
+		if err = fn(snapshot); err != nil {
+			return err
 		}
 	}
 }
 
 func (c *grpcClient) Close() {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
 	if c.conn != nil {
 		c.conn.Close()
+		c.conn = nil
 	}
 }
 
-func (c *grpcClient) doTransfer(ctx context.Context, file *os.File, id string, offset int64) (*proto.ChunkResult, error) {
+// doTransfer streams r to the upload id starting at offset, compressing
+// chunks with codec. The last chunk carries the whole file digest
+// returned by sum.
+func (c *grpcClient) doTransfer(ctx context.Context, log *Logger, r io.Reader, id string, codec proto.Codec, offset int64, sum func() string) (*proto.ChunkResult, error) {
 	stream, err := c.innerClient.Write(ctx)
 	if err != nil {
 		return nil, err
 	}
 	defer stream.CloseSend()
-	buf := make([]byte, 20)
+	buf := make([]byte, chunk_size)
 
-	log.Println("start transfer from", offset)
+	log.Debug("stream started", "offset", offset)
 	var num int
 	for {
-		num, err = file.Read(buf)
-		if err != nil {
-			if err == io.EOF {
-				return stream.CloseAndRecv()
+		num, err = r.Read(buf)
+		if num > 0 {
+			content, chunkCodec := encodeChunk(codec, buf[:num])
+			if err := c.limiter.wait(ctx, len(content)); err != nil {
+				return nil, err
 			}
+			if err := stream.Send(&proto.Chunk{
+				Offset:  offset,
+				Id:      id,
+				Content: content,
+				Codec:   chunkCodec,
+			}); err != nil {
+				return nil, sendError(stream, err)
+			}
+			log.Debug("chunk", "offset", offset, "size", num, "sent", len(content), "codec", chunkCodec)
+			offset += int64(num)
+		}
+		if err == io.EOF {
+			if err = stream.Send(&proto.Chunk{
+				Offset: offset,
+				Id:     id,
+				Digest: sum(),
+			}); err != nil {
+				return nil, sendError(stream, err)
+			}
+			return stream.CloseAndRecv()
+		}
+		if err != nil {
+			return nil, err
 		}
-		offset += int64(num)
-		stream.Send(&proto.Chunk{
-			Offset:  offset,
-			Id:      id,
-			Content: buf[:num],
-		})
 	}
 }
 
+// sendError digs out why a stream broke, Send only reports io.EOF when
+// the server has ended the call.
+func sendError(stream proto.TransferService_WriteClient, err error) error {
+	if err != io.EOF {
+		return err
+	}
+	if _, err = stream.CloseAndRecv(); err != nil {
+		return err
+	}
+	return errors.New("server ended the upload early")
+}
+
+// reconnect makes the connection dial again right away instead of
+// waiting out its own backoff.
+func (c *grpcClient) reconnect() {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	if c.conn != nil {
+		c.conn.ResetConnectBackoff()
+	}
+}
+
+// initConn dials the server once, later calls share the connection
+// until Close.
 func (c *grpcClient) initConn() error {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	if c.conn != nil {
+		return nil
+	}
+
 	var opts []grpc.DialOption
 	var err error
 
 	config := c.config
 	if config.tls {
-		creds, err := credentials.NewClientTLSFromFile(config.caFile, config.serverHostOverride)
+		tlsConfig, err := clientTLSConfig(config.caFile, config.serverHostOverride, config.certFile, config.keyFile)
 		if err != nil {
 			return err
 		}
-		opts = append(opts, grpc.WithTransportCredentials(creds))
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
 	} else {
 		opts = append(opts, grpc.WithInsecure())
 	}
+	if config.token != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(tokenCredentials(config.token)))
+	}
 	opts = append(opts, grpc.WithBlock())
 
-	c.conn, err = grpc.Dial(c.address, opts...)
+	ctx, cancel := context.WithTimeout(context.Background(), dial_timeout)
+	defer cancel()
+	c.conn, err = grpc.DialContext(ctx, c.address, opts...)
 	if err != nil {
-		return err
+		return status.Errorf(codes.Unavailable, "failed to connect to %s: %v", c.address, err)
 	}
 	c.innerClient = proto.NewTransferServiceClient(c.conn)
 	return nil
 }
 
-func (c *grpcClient) doOpen(ctx context.Context, fname string, append bool) (*proto.FileInfoResult, error) {
+// doOpen waits up to dial_timeout for the connection to come back
+// instead of failing while it reconnects.
+func (c *grpcClient) doOpen(ctx context.Context, name string, size int64, append bool) (*proto.FileInfoResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, dial_timeout)
+	defer cancel()
 	return c.innerClient.Open(ctx, &proto.FileInfo{
-		Name:   GetName(fname),
-		Size:   1024, //todo size check
-		Md5:    "",   //todo md5 check
-		Append: append,
-	})
+		Name:       name,
+		Size:       size,
+		Append:     append,
+		DigestType: c.config.digest,
+		Codecs:     c.config.codecs,
+	}, grpc.WaitForReady(true))
 }
@@ -2,20 +2,45 @@ package internal
 
 import (
 	"context"
+	"crypto/tls"
+	"fmt"
 	"io"
-	"log"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 	"wangweizZZ/go-daily-study/file-transfer/internal/proto"
 
 	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
 )
 
 const (
 	tmp_path        string = "./tmp/"
 	tmp_file_suffix string = ".tmp"
+	chunk_size      int    = 32 * 1024
+	max_page_size   int    = 1000
+
+	min_watch_interval time.Duration = 100 * time.Millisecond
+	// open sessions are saved this often while data arrives, so even a
+	// crashed server knows roughly what it has
+	session_save_interval time.Duration = time.Second
+	default_drain_timeout time.Duration = 30 * time.Second
 )
 
 var _ Server = &grpcServer{}
@@ -25,13 +50,43 @@ type grpcServer struct {
 	address     string
 	innerServer *grpc.Server
 	proto.UnimplementedTransferServiceServer
+
+	mu       sync.Mutex
+	uploads  map[string]*upload
+	reserved map[string]*reservation
+	sessions sessionStore
+	storage  Storage
+	limits   *rateLimits
+	metrics  *transferMetrics
+	http     *http.Server
+	gateway  *http.Server
+	health   *health.Server
+	stopOnce sync.Once
+	log      *Logger
+	shares   *shareStore
+	replicas *replicator
 }
 
 type serverConfig struct {
-	tls      bool
-	certFile string
-	key      string
-	store    string
+	tls          bool
+	certFile     string
+	key          string
+	clientCaFile string
+	tokenFile    string
+	store        string
+	storage      Storage
+	globalRate   int64
+	clientRate   int64
+	maxFileSize  int64
+	quota        int64
+	metricsAddr  string
+	httpAddr     string
+	shareURL     string
+	shareTTL     time.Duration
+	replicaPeers []string
+	replicaOpts  []ClientOption
+	drainTimeout time.Duration
+	logger       *Logger
 }
 
 type ServerOption func(*serverConfig)
@@ -44,16 +99,115 @@ func WithServerTls(certFile string, key string) ServerOption {
 	}
 }
 
+// WithServerClientCA requires every client to present a certificate
+// signed by a CA in caFile, it only takes effect together with tls.
+func WithServerClientCA(caFile string) ServerOption {
+	return func(sc *serverConfig) {
+		sc.clientCaFile = caFile
+	}
+}
+
+// WithServerTokens turns on bearer token authentication with the users
+// listed in tokenFile, each user only sees its own directory of the store.
+func WithServerTokens(tokenFile string) ServerOption {
+	return func(sc *serverConfig) {
+		sc.tokenFile = tokenFile
+	}
+}
+
+// WithServerRateLimit caps uploads to global bytes per second for the
+// whole server and perClient for every caller, zero means unlimited.
+func WithServerRateLimit(global int64, perClient int64) ServerOption {
+	return func(sc *serverConfig) {
+		sc.globalRate = global
+		sc.clientRate = perClient
+	}
+}
+
+// WithServerQuota rejects uploads larger than maxFileSize and uploads
+// that would take a user over quota bytes, zero means unlimited. Without
+// a token file the quota covers the whole store.
+func WithServerQuota(maxFileSize int64, quota int64) ServerOption {
+	return func(sc *serverConfig) {
+		sc.maxFileSize = maxFileSize
+		sc.quota = quota
+	}
+}
+
+// WithServerMetrics serves Prometheus metrics on addr under /metrics.
+func WithServerMetrics(addr string) ServerOption {
+	return func(sc *serverConfig) {
+		sc.metricsAddr = addr
+	}
+}
+
+// WithServerHTTP serves the files over plain HTTP on addr too, for
+// clients such as curl, see httpGateway.
+func WithServerHTTP(addr string) ServerOption {
+	return func(sc *serverConfig) {
+		sc.httpAddr = addr
+	}
+}
+
+// WithServerShareLinks sets how long share links work unless asked
+// otherwise, and the base url of the links, which defaults to the http
+// gateway.
+func WithServerShareLinks(baseURL string, ttl time.Duration) ServerOption {
+	return func(sc *serverConfig) {
+		sc.shareURL = baseURL
+		sc.shareTTL = ttl
+	}
+}
+
+// WithServerReplication pushes every upload committed on the server to
+// the servers at peers, opts configure the clients doing so. It needs
+// WithServerTokens, pushes of peers are only told apart from uploads by
+// their replica user.
+func WithServerReplication(peers []string, opts ...ClientOption) ServerOption {
+	return func(sc *serverConfig) {
+		sc.replicaPeers = peers
+		sc.replicaOpts = opts
+	}
+}
+
+// WithServerDrainTimeout is how long Shutdown waits for running calls
+// before cutting them off.
+func WithServerDrainTimeout(timeout time.Duration) ServerOption {
+	return func(sc *serverConfig) {
+		sc.drainTimeout = timeout
+	}
+}
+
+// WithServerLogger writes the log of the server to logger instead of
+// stderr.
+func WithServerLogger(logger *Logger) ServerOption {
+	return func(sc *serverConfig) {
+		sc.logger = logger
+	}
+}
+
+// WithServerStore keeps the upload sessions in the directory store, and
+// the files too unless another storage is given.
 func WithServerStore(store string) ServerOption {
 	return func(sc *serverConfig) {
 		sc.store = store
 	}
 }
 
+// WithServerStorage keeps the files in storage instead of the store
+// directory.
+func WithServerStorage(storage Storage) ServerOption {
+	return func(sc *serverConfig) {
+		sc.storage = storage
+	}
+}
+
 func NewServerConfig(opts ...ServerOption) *serverConfig {
 	serverConfig := &serverConfig{
-		tls:   false,
-		store: tmp_path,
+		tls:          false,
+		store:        tmp_path,
+		shareTTL:     default_share_ttl,
+		drainTimeout: default_drain_timeout,
 	}
 	for _, opt := range opts {
 		opt(serverConfig)
@@ -62,133 +216,1100 @@ func NewServerConfig(opts ...ServerOption) *serverConfig {
 }
 
 var DefaultServerConfig *serverConfig = &serverConfig{
-	tls:   false,
-	store: tmp_path,
+	tls:          false,
+	store:        tmp_path,
+	shareTTL:     default_share_ttl,
+	drainTimeout: default_drain_timeout,
 }
 
 func NewGrpcServer(add string, conf *serverConfig) *grpcServer {
-	return &grpcServer{
-		config:  conf,
-		address: add,
+	storage := conf.storage
+	if storage == nil {
+		storage = NewLocalStorage(conf.store)
+	}
+	logger := conf.logger
+	if logger == nil {
+		logger = defaultLogger
 	}
+	s := &grpcServer{
+		config:   conf,
+		address:  add,
+		uploads:  make(map[string]*upload),
+		reserved: make(map[string]*reservation),
+		sessions: sessionStore{dir: filepath.Join(conf.store, session_dir)},
+		storage:  storage,
+		limits:   newRateLimits(conf.globalRate, conf.clientRate),
+		log:      logger,
+	}
+	s.metrics = newTransferMetrics(func() float64 {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return float64(len(s.uploads))
+	})
+	return s
 }
 
 func (s *grpcServer) Open(ctx context.Context, finfo *proto.FileInfo) (*proto.FileInfoResult, error) {
 	//check arg
-	localFile, err := s.readyLocalFile(finfo.GetName())
+	key, err := s.storeKey(ctx, finfo.GetName())
 	if err != nil {
 		return nil, err
 	}
-	defer func() {
-		if localFile != nil {
-			localFile.Close()
-		}
-	}()
+	name, _ := cleanName(finfo.GetName())
+	if finfo.GetSize() < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid size %d", finfo.GetSize())
+	}
+	digestType := negotiateDigest(finfo.GetDigestType())
+	codec := negotiateCodec(finfo.GetCodecs())
+	owner := callerIdentity(ctx)
+	replaced := s.replacedSize(key)
 
-	var offset int64
-	if finfo.GetAppend() {
-		offset, err = localFile.Seek(0, 2)
-		if err != nil {
-			return nil, err
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var prev *upload
+	if id := finfo.GetId(); id != "" {
+		if prev = s.uploads[id]; prev == nil || prev.owner != owner {
+			return nil, status.Errorf(codes.NotFound, "upload %s not found", id)
+		}
+		if prev.name != name || prev.size != finfo.GetSize() || prev.digestType != digestType {
+			return nil, status.Errorf(codes.FailedPrecondition, "upload %s was opened for a different file", id)
 		}
-	} else {
-		localFile.Truncate(0)
+	} else if finfo.GetAppend() {
+		prev = s.findUpload(name, owner, finfo.GetSize(), digestType)
+	}
+	if prev != nil {
+		//other streams may still be writing to it, keep sharing
+		prev.mu.Lock()
+		defer prev.mu.Unlock()
+		s.uploadLogger(ctx, prev.id, name).Info("upload resumed", "offset", prev.received.contiguous(), "size", prev.size)
+		return &proto.FileInfoResult{
+			Id:         prev.id,
+			Offset:     prev.received.contiguous(),
+			DigestType: digestType,
+			Codec:      codec,
+		}, nil
+	}
+
+	up, err := s.openUpload(ctx, key, name, finfo.GetSize(), replaced, digestType, finfo.GetMd5())
+	if err != nil {
+		return nil, err
 	}
+	s.uploadLogger(ctx, up.id, name).Info("upload opened", "size", up.size, "digest", digestType, "codec", codec)
 
 	return &proto.FileInfoResult{
-		Id:     finfo.GetName(),
-		Offset: offset,
+		Id:         up.id,
+		Offset:     0,
+		DigestType: digestType,
+		Codec:      codec,
 	}, nil
 }
 
+// openUpload admits and starts a new session for the caller of ctx, the
+// caller holds s.mu.
+func (s *grpcServer) openUpload(ctx context.Context, key string, name string, size int64, replaced int64, digestType proto.DigestType, md5 string) (*upload, error) {
+	if err := s.admit(ctx, key, size, replaced); err != nil {
+		return nil, err
+	}
+	id, err := newSessionId()
+	if err != nil {
+		return nil, err
+	}
+	up, err := newUpload(id, name, callerIdentity(ctx), size, digestType, md5)
+	if err != nil {
+		return nil, err
+	}
+	staged, err := s.storage.Create(up.id)
+	if err != nil {
+		return nil, err
+	}
+	staged.Close()
+	if err = s.sessions.save(up); err != nil {
+		s.storage.Abort(up.id)
+		return nil, err
+	}
+	s.uploads[up.id] = up
+	return up, nil
+}
+
+// completeUpload commits up once every range has arrived, any stream
+// writing to it may call it when it ends.
+func (s *grpcServer) completeUpload(ctx context.Context, log *Logger, up *upload, staged StagedFile) (*proto.ChunkResult, error) {
+	return up.finish(staged, func() error {
+		if err := s.commitUpload(ctx, up); err != nil {
+			log.Error("commit upload failed", "error", err)
+			return err
+		}
+		log.Info("upload committed", "size", up.size, "duration", time.Since(up.created))
+		return nil
+	}, func() {
+		//the data on disk is wrong, so a resume must start over
+		log.Warn("upload dropped", "reason", "digest mismatch")
+		s.metrics.failures.WithLabelValues(failure_digest).Inc()
+		s.abortUpload(up)
+	})
+}
+
 func (s *grpcServer) Write(stream proto.TransferService_WriteServer) error {
-	var localFile *os.File
+	var (
+		staged StagedFile
+		up     *upload
+		log    *Logger
+		saved  = time.Now()
+	)
 	defer func() {
-		if localFile != nil {
-			localFile.Close()
+		if staged != nil {
+			staged.Close()
+		}
+		if up != nil {
+			//keep what arrived so far for a resume after a restart
+			if err := s.sessions.save(up); err != nil {
+				log.Warn("save upload failed", "error", err)
+			}
 		}
 	}()
 
 	for {
 		in, err := stream.Recv()
 		if err == io.EOF {
-			//todo check md5
-
-			size, err := localFile.Seek(0, 2)
-			if err != nil {
-				return nil
+			if up == nil {
+				return stream.SendAndClose(&proto.ChunkResult{
+					Code: proto.ResultCode_Ok,
+				})
 			}
-			if localFile != nil {
-				err = os.Rename(localFile.Name(), localFile.Name()[:len(localFile.Name())-len(tmp_file_suffix)])
-				if err != nil {
-					return err
-				}
+			result, err := s.completeUpload(stream.Context(), log, up, staged)
+			if err != nil {
+				return err
 			}
-			return stream.SendAndClose(&proto.ChunkResult{
-				Offset: size,
-				Code:   proto.ResultCode_Ok,
-			})
+			log.Debug("stream ended", "code", result.GetCode(), "offset", result.GetOffset())
+			return stream.SendAndClose(result)
 		}
 
 		if err != nil {
 			return err
 		}
 
-		if localFile == nil {
-			localFile, err = s.readyLocalFile(in.GetId())
-			if err != nil {
+		if up == nil {
+			if up = s.getUpload(in.GetId()); up == nil {
+				return status.Errorf(codes.FailedPrecondition, "upload %s is not opened", in.GetId())
+			}
+			if up.owner != callerIdentity(stream.Context()) {
+				up = nil
+				return status.Errorf(codes.PermissionDenied, "upload %s belongs to someone else", in.GetId())
+			}
+			log = s.uploadLogger(stream.Context(), up.id, up.name)
+			log.Debug("stream started", "offset", in.GetOffset())
+			if staged, err = s.storage.OpenStaged(up.id); err != nil {
 				return err
 			}
-			if _, err = localFile.Seek(0, 2); err != nil {
+		}
+
+		if err = s.limits.wait(stream.Context(), up.owner, len(in.GetContent())); err != nil {
+			return err
+		}
+		if in.Content, err = decodeChunk(in.GetCodec(), in.GetContent()); err != nil {
+			return status.Errorf(codes.InvalidArgument, "bad %s chunk at %d: %v", in.GetCodec(), in.GetOffset(), err)
+		}
+		if err = up.write(staged, in); err != nil {
+			return err
+		}
+		log.Debug("chunk", "offset", in.GetOffset(), "size", len(in.GetContent()), "codec", in.GetCodec())
+		s.metrics.receivedBytes.Add(float64(len(in.GetContent())))
+		if time.Since(saved) > session_save_interval {
+			if err = s.sessions.save(up); err != nil {
 				return err
 			}
+			saved = time.Now()
+		}
+	}
+}
+
+// Manifest compares a directory listing with the store and reports the
+// entries that are missing or differ.
+func (s *grpcServer) Manifest(ctx context.Context, req *proto.ManifestRequest) (*proto.ManifestResult, error) {
+	if _, err := newDigest(req.GetDigestType()); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	result := &proto.ManifestResult{}
+	for _, entry := range req.GetEntries() {
+		key, err := s.storeKey(ctx, entry.GetName())
+		if err != nil {
+			return nil, err
+		}
+		same, err := s.sameFile(key, entry, req.GetDigestType())
+		if err != nil {
+			return nil, err
 		}
+		if !same {
+			result.Missing = append(result.Missing, entry.GetName())
+		}
+	}
+	return result, nil
+}
 
-		if _, err = localFile.Write([]byte(in.Content)); err != nil {
+func (s *grpcServer) Read(req *proto.FileRequest, stream proto.TransferService_ReadServer) error {
+	key, err := s.storeKey(stream.Context(), req.GetName())
+	if err != nil {
+		return err
+	}
+	stored, err := s.storage.Open(key)
+	if err != nil {
+		return fileError(err)
+	}
+	defer stored.Close()
+
+	return sendFile(stream, stored, req.GetName(), req.GetOffset())
+}
+
+// ReadShared sends the file a share link was issued for to anyone
+// holding its token. Every call that sends something counts as a
+// download, resuming one from an offset included.
+func (s *grpcServer) ReadShared(req *proto.SharedFileRequest, stream proto.TransferService_ReadSharedServer) error {
+	id, err := s.shares.verify(req.GetToken())
+	if err != nil {
+		return err
+	}
+	link, err := s.shares.use(id)
+	if err != nil {
+		return err
+	}
+	sender := &sentSender{chunkSender: stream}
+	err = func() error {
+		stored, err := s.storage.Open(link.Key)
+		if err != nil {
+			return fileError(err)
+		}
+		defer stored.Close()
+		return sendFile(sender, stored, path.Base(link.Key), req.GetOffset())
+	}()
+	if !sender.sent {
+		if err := s.shares.release(id); err != nil {
+			s.log.Error("giving back share download failed", "share", id, "error", err)
+		}
+		return err
+	}
+	s.log.Info("share link used", "share", link.Id, "file", link.Key, "peer", peerAddress(stream.Context()), "uses", link.Uses, "error", err)
+	return err
+}
+
+// sentSender notes whether a chunk went out on a stream.
+type sentSender struct {
+	chunkSender
+	sent bool
+}
+
+func (s *sentSender) Send(chunk *proto.Chunk) error {
+	err := s.chunkSender.Send(chunk)
+	if err == nil {
+		s.sent = true
+	}
+	return err
+}
+
+// chunkSender is a server stream of chunks, such as Read's.
+type chunkSender interface {
+	Send(*proto.Chunk) error
+}
+
+// sendFile streams stored from offset in chunks named name, and ends
+// with an empty chunk holding the sha256 of the whole file so a resumed
+// download can tell the file changed since its first part.
+func sendFile(stream chunkSender, stored StoredFile, name string, offset int64) error {
+	if offset < 0 || offset > stored.Info().Size {
+		return status.Errorf(codes.InvalidArgument, "invalid offset %d", offset)
+	}
+	digest, _ := newDigest(proto.DigestType_Sha256)
+	if err := digestPrefix(digest, stored, offset); err != nil {
+		return err
+	}
+	r := io.NewSectionReader(stored, offset, stored.Info().Size-offset)
+	buf := make([]byte, chunk_size)
+	for {
+		num, err := r.Read(buf)
+		if num > 0 {
+			digest.Write(buf[:num])
+			if err := stream.Send(&proto.Chunk{
+				Id:      name,
+				Offset:  offset,
+				Content: buf[:num],
+			}); err != nil {
+				return err
+			}
+			offset += int64(num)
+		}
+		if err == io.EOF {
+			return stream.Send(&proto.Chunk{Id: name, Offset: offset, Digest: sumHex(digest)})
+		}
+		if err != nil {
 			return err
 		}
 	}
 }
 
+// Share issues a link to a file of the caller that works without
+// credentials until it expires, is used up or is revoked.
+func (s *grpcServer) Share(ctx context.Context, req *proto.ShareRequest) (*proto.ShareLink, error) {
+	key, err := s.storeKey(ctx, req.GetName())
+	if err != nil {
+		return nil, err
+	}
+	if req.GetTtlSeconds() < 0 || req.GetMaxDownloads() < 0 {
+		return nil, status.Error(codes.InvalidArgument, "ttl and max downloads must not be negative")
+	}
+	if _, err = s.storage.Stat(key); err != nil {
+		return nil, fileError(err)
+	}
+	ttl := time.Duration(req.GetTtlSeconds()) * time.Second
+	if ttl == 0 {
+		ttl = s.config.shareTTL
+	}
+	link, token, err := s.shares.issue(key, callerIdentity(ctx), ttl, req.GetMaxDownloads())
+	if err != nil {
+		return nil, err
+	}
+	s.log.Info("share link issued", "share", link.Id, "file", key, "user", link.Owner, "expires", time.Unix(link.Expires, 0), "max_downloads", link.Max)
+	return &proto.ShareLink{
+		Id:           link.Id,
+		Token:        token,
+		Url:          s.shareURL(token),
+		Expires:      link.Expires,
+		MaxDownloads: link.Max,
+	}, nil
+}
+
+// RevokeShare stops a share link from working.
+func (s *grpcServer) RevokeShare(ctx context.Context, req *proto.RevokeShareRequest) (*emptypb.Empty, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	link, err := s.shares.revoke(req.GetId())
+	if err != nil {
+		return nil, err
+	}
+	s.log.Info("share link revoked", "share", link.Id, "file", link.Key, "user", callerIdentity(ctx))
+	return &emptypb.Empty{}, nil
+}
+
+// shareURL is where the http gateway serves a token, empty without one.
+func (s *grpcServer) shareURL(token string) string {
+	base := s.config.shareURL
+	if base == "" && s.config.httpAddr != "" {
+		host, port, err := net.SplitHostPort(s.config.httpAddr)
+		if err != nil {
+			return ""
+		}
+		if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+			host = "localhost"
+		}
+		scheme := "http"
+		if s.config.tls {
+			scheme = "https"
+		}
+		base = scheme + "://" + net.JoinHostPort(host, port)
+	}
+	if base == "" {
+		return ""
+	}
+	return strings.TrimSuffix(base, "/") + share_path + token
+}
+
+func (s *grpcServer) List(ctx context.Context, req *proto.ListRequest) (*proto.ListResult, error) {
+	pageSize := int(req.GetPageSize())
+	if pageSize <= 0 || pageSize > max_page_size {
+		pageSize = max_page_size
+	}
+
+	root := s.userPrefix(ctx)
+	infos, err := s.storage.List(root + req.GetPrefix())
+	if err != nil {
+		return nil, err
+	}
+	var files []*proto.FileStat
+	for _, info := range infos {
+		name := strings.TrimPrefix(info.Name, root)
+		if name > req.GetPageToken() {
+			files = append(files, newFileStat(name, info))
+		}
+	}
+
+	//the token is the last name sent, so pages follow name order
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	result := &proto.ListResult{Files: files}
+	if len(files) > pageSize {
+		result.Files = files[:pageSize]
+		result.NextPageToken = files[pageSize-1].Name
+	}
+	return result, nil
+}
+
+func (s *grpcServer) Stat(ctx context.Context, req *proto.StatRequest) (*proto.FileStat, error) {
+	key, err := s.storeKey(ctx, req.GetName())
+	if err != nil {
+		return nil, err
+	}
+	info, err := s.storage.Stat(key)
+	if err != nil {
+		return nil, fileError(err)
+	}
+	name, _ := cleanName(req.GetName())
+	return newFileStat(name, info), nil
+}
+
+func (s *grpcServer) Delete(ctx context.Context, req *proto.DeleteRequest) (*emptypb.Empty, error) {
+	key, err := s.storeKey(ctx, req.GetName())
+	if err != nil {
+		return nil, err
+	}
+	if err = s.storage.Delete(key); err != nil {
+		return nil, fileError(err)
+	}
+	s.log.Info("file deleted", "file", req.GetName(), "user", callerIdentity(ctx))
+	return &emptypb.Empty{}, nil
+}
+
+func (s *grpcServer) Rename(ctx context.Context, req *proto.RenameRequest) (*proto.FileStat, error) {
+	from, err := s.storeKey(ctx, req.GetFrom())
+	if err != nil {
+		return nil, err
+	}
+	to, err := s.storeKey(ctx, req.GetTo())
+	if err != nil {
+		return nil, err
+	}
+	if err = s.storage.Rename(from, to); err != nil {
+		if os.IsExist(err) {
+			return nil, status.Errorf(codes.AlreadyExists, "%s already exists", req.GetTo())
+		}
+		return nil, fileError(err)
+	}
+	s.log.Info("file renamed", "from", req.GetFrom(), "to", req.GetTo(), "user", callerIdentity(ctx))
+	return s.Stat(ctx, &proto.StatRequest{Name: req.GetTo()})
+}
+
+// Signatures describes the blocks of a stored file, the client uses them
+// to send only what changed through Patch.
+func (s *grpcServer) Signatures(req *proto.SignatureRequest, stream proto.TransferService_SignaturesServer) error {
+	key, err := s.storeKey(stream.Context(), req.GetName())
+	if err != nil {
+		return err
+	}
+	stored, err := s.storage.Open(key)
+	if err != nil {
+		return fileError(err)
+	}
+	defer stored.Close()
+	info := stored.Info()
+
+	header := &proto.SignatureBatch{
+		BlockSize: int32(deltaBlockSize(info.Size)),
+		Size:      info.Size,
+		ModTime:   info.ModTime.UnixNano(),
+	}
+	err = blockSignatures(io.NewSectionReader(stored, 0, info.Size), int(header.BlockSize), func(blocks []*proto.BlockSignature) error {
+		batch := &proto.SignatureBatch{Blocks: blocks}
+		if header != nil {
+			header.Blocks, batch, header = blocks, header, nil
+		}
+		return stream.Send(batch)
+	})
+	if err != nil {
+		return err
+	}
+	if header != nil {
+		//an empty file has no blocks, the client still needs the header
+		return stream.Send(header)
+	}
+	return nil
+}
+
+// Patch builds a new version of a stored file from its old version and
+// a delta, the old version is only replaced once the digest matches.
+func (s *grpcServer) Patch(stream proto.TransferService_PatchServer) error {
+	ctx := stream.Context()
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	header := first.GetHeader()
+	if header == nil {
+		return status.Error(codes.InvalidArgument, "delta must start with a header")
+	}
+	if header.GetBlockSize() <= 0 || int(header.GetBlockSize()) > max_block_size || header.GetSize() < 0 {
+		return status.Errorf(codes.InvalidArgument, "invalid delta header %v", header)
+	}
+	key, err := s.storeKey(ctx, header.GetName())
+	if err != nil {
+		return err
+	}
+	base, err := s.storage.Open(key)
+	if err != nil {
+		return fileError(err)
+	}
+	defer base.Close()
+	info := base.Info()
+	if info.Size != header.GetBaseSize() || info.ModTime.UnixNano() != header.GetBaseModTime() {
+		return status.Errorf(codes.FailedPrecondition, "%s changed since its signatures were taken", header.GetName())
+	}
+	digest, err := newDigest(header.GetDigestType())
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	id, err := newSessionId()
+	if err != nil {
+		return err
+	}
+	//held until the patch ends, so concurrent uploads can not overbook
+	s.mu.Lock()
+	reserved, err := s.reserve(ctx, id, key, header.GetSize(), info.Size)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	defer s.release(id)
+	started := time.Now()
+
+	log := s.uploadLogger(ctx, id, header.GetName())
+	log.Info("patch opened", "size", header.GetSize(), "base_size", info.Size, "block_size", header.GetBlockSize())
+	staged, err := s.storage.Create(id)
+	if err != nil {
+		return err
+	}
+	committed := false
+	defer func() {
+		staged.Close()
+		if !committed {
+			s.storage.Abort(id)
+		}
+	}()
+
+	patcher := &deltaPatcher{
+		base:      base,
+		baseSize:  info.Size,
+		blockSize: int64(header.GetBlockSize()),
+		out:       io.MultiWriter(&offsetWriter{w: staged}, digest),
+		size:      header.GetSize(),
+	}
+	var literal int64
+	for {
+		op, err := stream.Recv()
+		if err == io.EOF {
+			return status.Error(codes.InvalidArgument, "delta ended without a digest")
+		}
+		if err != nil {
+			return err
+		}
+
+		expected, ok := op.GetOp().(*proto.DeltaOp_Digest)
+		if !ok {
+			if data := op.GetData(); data != nil {
+				if err = s.limits.wait(ctx, callerIdentity(ctx), len(data)); err != nil {
+					return err
+				}
+				literal += int64(len(data))
+				s.metrics.receivedBytes.Add(float64(len(data)))
+			}
+			log.Debug("delta op", "copy", op.GetCopy() != nil, "data", len(op.GetData()), "written", patcher.written)
+			if err = patcher.apply(op); err != nil {
+				log.Warn("patch rejected", "error", err)
+				s.metrics.failures.WithLabelValues(failure_patch).Inc()
+				return status.Error(codes.InvalidArgument, err.Error())
+			}
+			atomic.StoreInt64(&reserved.written, patcher.written)
+			continue
+		}
+
+		if patcher.written != header.GetSize() {
+			log.Warn("patch dropped", "reason", "size mismatch", "written", patcher.written)
+			s.metrics.failures.WithLabelValues(failure_patch).Inc()
+			return stream.SendAndClose(&proto.ChunkResult{
+				Offset:  patcher.written,
+				Code:    proto.ResultCode_Failed,
+				Message: fmt.Sprintf("delta rebuilt %d bytes, expected %d", patcher.written, header.GetSize()),
+			})
+		}
+		if actual := sumHex(digest); actual != expected.Digest {
+			log.Warn("patch dropped", "reason", "digest mismatch")
+			s.metrics.failures.WithLabelValues(failure_digest).Inc()
+			return stream.SendAndClose(&proto.ChunkResult{
+				Offset:  patcher.written,
+				Code:    proto.ResultCode_Failed,
+				Message: fmt.Sprintf("%s mismatch: expected %s, got %s", header.GetDigestType(), expected.Digest, actual),
+			})
+		}
+		if err = staged.Close(); err != nil {
+			return err
+		}
+		if err = s.storage.Commit(id, key, patcher.written); err != nil {
+			log.Error("commit patch failed", "error", err)
+			s.metrics.failures.WithLabelValues(failure_commit).Inc()
+			return err
+		}
+		committed = true
+		s.metrics.committed(patcher.written, started)
+		s.replicate(stream.Context(), key)
+		log.Info("upload patched", "size", patcher.written, "literal", literal, "duration", time.Since(started))
+		return stream.SendAndClose(&proto.ChunkResult{
+			Offset: patcher.written,
+			Code:   proto.ResultCode_Ok,
+		})
+	}
+}
+
+func (s *grpcServer) SetRateLimit(ctx context.Context, req *proto.RateLimit) (*proto.RateLimit, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	global, perClient := s.limits.set(req.GetGlobal(), req.GetPerClient())
+	s.log.Info("rate limit set", "global", global, "per_client", perClient, "user", callerIdentity(ctx))
+	return &proto.RateLimit{Global: global, PerClient: perClient}, nil
+}
+
+// WatchTransfers sends the progress of every open session until the
+// caller goes away.
+func (s *grpcServer) WatchTransfers(req *proto.WatchRequest, stream proto.TransferService_WatchTransfersServer) error {
+	if err := requireAdmin(stream.Context()); err != nil {
+		return err
+	}
+	interval := time.Duration(req.GetIntervalMs()) * time.Millisecond
+	if interval < min_watch_interval {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last := make(map[string]int64)
+	for {
+		if err := stream.Send(s.snapshotTransfers(last, interval)); err != nil {
+			return err
+		}
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// snapshotTransfers reports the open sessions, last holds what each had
+// received at the previous snapshot and is updated in place.
+func (s *grpcServer) snapshotTransfers(last map[string]int64, interval time.Duration) *proto.TransferSnapshot {
+	s.mu.Lock()
+	uploads := make([]*upload, 0, len(s.uploads))
+	for _, up := range s.uploads {
+		uploads = append(uploads, up)
+	}
+	s.mu.Unlock()
+	sort.Slice(uploads, func(i, j int) bool { return uploads[i].created.Before(uploads[j].created) })
+
+	snapshot := &proto.TransferSnapshot{}
+	seen := make(map[string]int64, len(uploads))
+	for _, up := range uploads {
+		up.mu.Lock()
+		received := up.received.total()
+		up.mu.Unlock()
+
+		var rate int64
+		if prev, ok := last[up.id]; ok {
+			rate = int64(float64(received-prev) / interval.Seconds())
+		}
+		seen[up.id] = received
+		snapshot.Transfers = append(snapshot.Transfers, &proto.TransferProgress{
+			Id:       up.id,
+			Name:     up.name,
+			Owner:    up.owner,
+			Size:     up.size,
+			Received: received,
+			Rate:     rate,
+			Created:  up.created.Unix(),
+		})
+	}
+	for id := range last {
+		delete(last, id)
+	}
+	for id, received := range seen {
+		last[id] = received
+	}
+	return snapshot
+}
+
 func (s *grpcServer) Start() error {
+	//without replica users two servers replicating to each other would
+	//send every file back and forth
+	if len(s.config.replicaPeers) > 0 && s.config.tokenFile == "" {
+		return errors.New("replication needs a token file")
+	}
 	lis, err := net.Listen("tcp", s.address)
 
 	if err != nil {
 		return errors.Wrapf(err, "failed to listen on address %s", s.address)
 	}
 	sc := s.config
-	var opts []grpc.ServerOption
+	var (
+		unary     []grpc.UnaryServerInterceptor
+		stream    []grpc.StreamServerInterceptor
+		auth      *authenticator
+		tlsConfig *tls.Config
+	)
+	if sc.metricsAddr != "" {
+		//outermost, so calls turned away by auth are counted too
+		unary = append(unary, s.metrics.grpc.UnaryServerInterceptor())
+		stream = append(stream, s.metrics.grpc.StreamServerInterceptor())
+	}
+	if sc.tokenFile != "" {
+		if auth, err = loadTokens(sc.tokenFile); err != nil {
+			return errors.Wrap(err, "failed to load tokens")
+		}
+		unary = append(unary, auth.unaryInterceptor)
+		stream = append(stream, auth.streamInterceptor)
+	}
+	unary = append(unary, s.identityUnaryInterceptor)
+	stream = append(stream, s.identityStreamInterceptor)
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(unary...),
+		grpc.ChainStreamInterceptor(stream...),
+	}
 	if sc.tls {
-		altsTC, err := credentials.NewServerTLSFromFile(sc.certFile, sc.key)
+		reloader, err := newCertReloader(sc.certFile, sc.key, sc.clientCaFile)
 		if err != nil {
 			return err
 		}
-		opts = append(opts, grpc.Creds(altsTC))
+		tlsConfig = reloader.config()
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+		go s.reloadOnHangup(reloader)
 	}
 
 	s.innerServer = grpc.NewServer(opts...)
 	proto.RegisterTransferServiceServer(s.innerServer, s)
+	s.health = health.NewServer()
+	s.health.SetServingStatus(proto.TransferService_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(s.innerServer, s.health)
+	s.metrics.grpc.InitializeMetrics(s.innerServer)
 
-	if _, err = os.Stat(tmp_path); os.IsNotExist(err) {
-		err = os.Mkdir(tmp_path, 0777)
+	if err = os.MkdirAll(sc.store, 0777); err != nil {
+		return errors.Wrapf(err, "failed to create store %s", sc.store)
 	}
-	if err != nil {
+	if err = s.loadUploads(); err != nil {
+		return err
+	}
+	if sc.quota > 0 {
+		//listed once, quotas are checked against counters from then on
+		if s.storage, err = newUsageStorage(s.storage); err != nil {
+			return errors.Wrap(err, "failed to count stored files")
+		}
+	}
+	if s.shares, err = loadShares(s.sessions.dir); err != nil {
 		return err
 	}
+	if len(sc.replicaPeers) > 0 {
+		if s.replicas, err = startReplication(s.storage, s.sessions.dir, s.log, sc.replicaPeers, sc.replicaOpts); err != nil {
+			return err
+		}
+		s.metrics.registry.MustRegister(replicationCollector{s.replicas})
+		s.log.Info("replicating committed files", "peers", strings.Join(sc.replicaPeers, ","))
+	}
 
-	log.Println("start to server Listen:", s.address)
+	if sc.metricsAddr != "" {
+		if err = s.serveMetrics(sc.metricsAddr); err != nil {
+			return err
+		}
+	}
+	if sc.httpAddr != "" {
+		if err = s.serveGateway(sc.httpAddr, auth, tlsConfig); err != nil {
+			return err
+		}
+	}
+
+	go s.shutdownOnSignal()
+	s.log.Info("server listening", "address", s.address)
 	if err := s.innerServer.Serve(lis); err != nil {
 		return errors.Wrapf(err, "failed listening connections")
 	}
 	return nil
 }
 
+// reloadOnHangup reads the certificates again whenever SIGHUP arrives,
+// connections keep their old certificate until they reconnect.
+func (s *grpcServer) reloadOnHangup(reloader *certReloader) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := reloader.reload(); err != nil {
+			s.log.Error("reload certificates failed", "error", err)
+			continue
+		}
+		s.log.Info("certificates reloaded")
+	}
+}
+
+// shutdownOnSignal drains the server on SIGINT or SIGTERM, a second
+// signal cuts the running calls off right away.
+func (s *grpcServer) shutdownOnSignal() {
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	s.log.Info("draining", "signal", <-sig, "timeout", s.config.drainTimeout)
+	go s.Shutdown()
+	s.log.Warn("stopping now", "signal", <-sig)
+	s.stop()
+}
+
+// Shutdown reports NOT_SERVING to health checks, stops taking new calls
+// and waits for running ones. Uploads still running after the drain
+// timeout are cut off and saved as sessions to resume.
+func (s *grpcServer) Shutdown() {
+	if s.innerServer == nil {
+		return
+	}
+	//watchers of the health service hear about it before the listener goes
+	s.health.Shutdown()
+
+	drained := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		if s.gateway != nil {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s.gateway.Shutdown(context.Background())
+			}()
+		}
+		s.innerServer.GracefulStop()
+		wg.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		s.log.Info("all calls finished")
+	case <-time.After(s.config.drainTimeout):
+		s.log.Warn("drain timeout passed", "timeout", s.config.drainTimeout)
+		s.stop()
+	}
+}
+
+// stop cuts off every running call and records the open uploads, their
+// Write streams may not get to it before the process exits.
+func (s *grpcServer) stop() {
+	s.stopOnce.Do(func() {
+		s.innerServer.Stop()
+		if s.gateway != nil {
+			s.gateway.Close()
+		}
+		s.mu.Lock()
+		uploads := make([]*upload, 0, len(s.uploads))
+		for _, up := range s.uploads {
+			uploads = append(uploads, up)
+		}
+		s.mu.Unlock()
+		for _, up := range uploads {
+			if err := s.sessions.save(up); err != nil {
+				s.log.Warn("save upload failed", "session", up.id, "error", err)
+			}
+		}
+		s.log.Info("saved open upload sessions", "count", len(uploads))
+		if s.replicas != nil {
+			s.replicas.close()
+		}
+	})
+}
+
+// serveMetrics answers Prometheus scrapes on addr in the background.
+func (s *grpcServer) serveMetrics(addr string) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrapf(err, "failed to listen on metrics address %s", addr)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(s.metrics.registry, promhttp.HandlerOpts{}))
+	s.http = &http.Server{Handler: mux}
+	go func() {
+		if err := s.http.Serve(lis); err != nil && err != http.ErrServerClosed {
+			s.log.Error("metrics server failed", "error", err)
+		}
+	}()
+	s.log.Info("serving metrics", "address", addr)
+	return nil
+}
+
 func (s *grpcServer) Close() {
 	if s.innerServer != nil {
-		s.innerServer.Stop()
+		s.stop()
+	}
+	if s.http != nil {
+		s.http.Close()
+	}
+}
+
+// userPrefix starts the keys of the storage the caller of ctx works in.
+func (s *grpcServer) userPrefix(ctx context.Context) string {
+	//replicas write the keys of the server they replicate
+	if u := userFrom(ctx); u != nil && !u.replica {
+		return u.name + "/"
+	}
+	return ""
+}
+
+// storeKey maps a name sent by a client to its key in the storage, every
+// rpc that touches a stored file goes through it.
+func (s *grpcServer) storeKey(ctx context.Context, name string) (string, error) {
+	clean, err := cleanName(name)
+	if err != nil {
+		return "", status.Error(codes.InvalidArgument, err.Error())
+	}
+	return s.userPrefix(ctx) + clean, nil
+}
+
+// uploadLogger is the logger of one request on the upload id.
+func (s *grpcServer) uploadLogger(ctx context.Context, id string, name string) *Logger {
+	return s.log.With("session", id, "peer", peerAddress(ctx), "user", callerIdentity(ctx), "file", name)
+}
+
+// loadUploads restores the sessions left open by an earlier server.
+func (s *grpcServer) loadUploads() error {
+	if err := os.MkdirAll(s.sessions.dir, 0777); err != nil {
+		return err
+	}
+	uploads, err := s.sessions.load()
+	if err != nil {
+		return errors.Wrap(err, "failed to load upload sessions")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	restored := 0
+	for _, up := range uploads {
+		//sessions whose data is gone can not be resumed
+		staged, err := s.storage.OpenStaged(up.id)
+		if os.IsNotExist(err) {
+			s.sessions.remove(up.id)
+			continue
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to open upload %s", up.id)
+		}
+		staged.Close()
+		s.uploads[up.id] = up
+		restored++
+	}
+	s.log.Info("restored upload sessions", "count", restored)
+	return nil
+}
+
+func (s *grpcServer) getUpload(id string) *upload {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.uploads[id]
+}
+
+// findUpload returns the latest session of owner that matches the file,
+// the caller holds s.mu.
+func (s *grpcServer) findUpload(name string, owner string, size int64, digestType proto.DigestType) *upload {
+	var found *upload
+	for _, up := range s.uploads {
+		if up.growing || up.name != name || up.owner != owner || up.size != size || up.digestType != digestType {
+			continue
+		}
+		if found == nil || up.created.After(found.created) {
+			found = up
+		}
+	}
+	return found
+}
+
+func (s *grpcServer) finishUpload(up *upload) {
+	s.mu.Lock()
+	if s.uploads[up.id] == up {
+		delete(s.uploads, up.id)
+	}
+	s.mu.Unlock()
+	if err := s.sessions.remove(up.id); err != nil {
+		s.log.Warn("remove upload failed", "session", up.id, "error", err)
+	}
+}
+
+// commitUpload publishes a complete upload under its name.
+func (s *grpcServer) commitUpload(ctx context.Context, up *upload) error {
+	key, err := s.storeKey(ctx, up.name)
+	if err != nil {
+		return err
+	}
+	if err = s.storage.Commit(up.id, key, up.size); err != nil {
+		s.metrics.failures.WithLabelValues(failure_commit).Inc()
+		return fileError(err)
+	}
+	s.metrics.committed(up.size, up.created)
+	s.finishUpload(up)
+	s.replicate(ctx, key)
+	return nil
+}
+
+// replicate queues a committed file for the replication peers, files
+// pushed by a peer are not sent back.
+func (s *grpcServer) replicate(ctx context.Context, key string) {
+	if s.replicas == nil || replicaPush(ctx) {
+		return
+	}
+	if err := s.replicas.enqueue(key); err != nil {
+		s.log.Error("queue replication failed", "file", key, "error", err)
+	}
+}
+
+// Replication reports how far behind every replication peer is.
+func (s *grpcServer) Replication(ctx context.Context, _ *emptypb.Empty) (*proto.ReplicationStatus, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	if s.replicas == nil {
+		return &proto.ReplicationStatus{}, nil
+	}
+	return &proto.ReplicationStatus{Peers: s.replicas.status()}, nil
+}
+
+// sameFile reports whether the stored file key matches entry.
+func (s *grpcServer) sameFile(key string, entry *proto.ManifestEntry, digestType proto.DigestType) (bool, error) {
+	stored, err := s.storage.Open(key)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fileError(err)
+	}
+	defer stored.Close()
+	if stored.Info().Size != entry.GetSize() {
+		return false, nil
+	}
+	digest, err := newDigest(digestType)
+	if err != nil {
+		return false, err
 	}
+	if err = digestPrefix(digest, stored, entry.GetSize()); err != nil {
+		return false, err
+	}
+	return sumHex(digest) == entry.GetDigest(), nil
 }
 
-func (s *grpcServer) readyLocalFile(fileName string) (*os.File, error) {
-	return os.OpenFile(s.config.store+fileName+tmp_file_suffix, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0666)
+// abortUpload throws away the data of a rejected upload.
+func (s *grpcServer) abortUpload(up *upload) {
+	if err := s.storage.Abort(up.id); err != nil {
+		s.log.Warn("abort upload failed", "session", up.id, "error", err)
+	}
+	s.finishUpload(up)
+}
+
+func newFileStat(name string, info FileInfo) *proto.FileStat {
+	return &proto.FileStat{
+		Name:    name,
+		Size:    info.Size,
+		ModTime: info.ModTime.Unix(),
+	}
+}
+
+// fileError turns a failed storage call into a grpc status.
+func fileError(err error) error {
+	switch {
+	case errors.Cause(err) == ErrInvalidKey:
+		return status.Error(codes.InvalidArgument, err.Error())
+	case os.IsNotExist(err):
+		return status.Error(codes.NotFound, "file not found")
+	case os.IsExist(err):
+		return status.Error(codes.AlreadyExists, "file already exists")
+	default:
+		return err
+	}
 }
@@ -0,0 +1,541 @@
+package internal
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"wangweizZZ/go-daily-study/file-transfer/internal/proto"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	files_path    string = "/files/"
+	share_path    string = "/share/"
+	digest_header string = "Digest"
+	sha256_digest string = "sha-256="
+	// http_resume_incomplete answers a ranged PUT that left parts of the
+	// file missing, as resumable uploads of other services do
+	http_resume_incomplete int = 308
+)
+
+// httpGateway serves the files of the server to clients that only speak
+// HTTP, such as shell scripts with curl:
+//
+//	PUT  /files/{name}  upload, resumable with Content-Range
+//	GET  /files/{name}  download, Range requests are honoured
+//	HEAD /files/{name}  size, modification time and sha-256 digest
+//	GET  /share/{token} download through a share link, no credentials
+//
+// Uploads are sessions like the ones opened over grpc, a Digest header
+// with a sha-256 value is checked before the file is committed.
+type httpGateway struct {
+	s    *grpcServer
+	auth *authenticator
+}
+
+// serveGateway answers HTTP on addr in the background, with TLS when
+// tlsConfig is set.
+func (s *grpcServer) serveGateway(addr string, auth *authenticator, tlsConfig *tls.Config) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return errors.Wrapf(err, "failed to listen on http address %s", addr)
+	}
+	if tlsConfig != nil {
+		lis = tls.NewListener(lis, tlsConfig)
+	}
+	s.gateway = &http.Server{Handler: &httpGateway{s: s, auth: auth}}
+	go func() {
+		if err := s.gateway.Serve(lis); err != nil && err != http.ErrServerClosed {
+			s.log.Error("http gateway failed", "error", err)
+		}
+	}()
+	s.log.Info("serving http gateway", "address", addr)
+	return nil
+}
+
+func (g *httpGateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, share_path) {
+		g.shared(w, r, strings.TrimPrefix(r.URL.Path, share_path))
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, files_path) {
+		http.NotFound(w, r)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, files_path)
+	ctx, err := g.context(r, r.Method == http.MethodPut)
+	if err != nil {
+		writeHTTPError(w, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		err = g.put(ctx, w, r, name)
+	case http.MethodGet, http.MethodHead:
+		err = g.get(ctx, w, r, name)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		writeHTTPError(w, err)
+	}
+}
+
+// context gives a request what the interceptors give a grpc call: the
+// peer, the user and the identity.
+func (g *httpGateway) context(r *http.Request, write bool) (context.Context, error) {
+	p := &peer.Peer{Addr: httpAddr(r.RemoteAddr)}
+	if r.TLS != nil {
+		p.AuthInfo = credentials.TLSInfo{State: *r.TLS}
+	}
+	ctx := peer.NewContext(r.Context(), p)
+	if g.auth != nil {
+		u, err := g.auth.lookup(r.Header.Get(auth_header), write)
+		if err != nil {
+			return nil, err
+		}
+		//peers push over grpc only
+		if u.replica {
+			return nil, status.Errorf(codes.PermissionDenied, "%s is a replica, it may only push files", u.name)
+		}
+		ctx = context.WithValue(ctx, userKey{}, u)
+	}
+	identity := peerIdentity(ctx)
+	g.s.log.Debug("call", "method", r.Method+" "+r.URL.Path, "peer", r.RemoteAddr, "user", identity)
+	return context.WithValue(ctx, identityKey{}, identity), nil
+}
+
+func (g *httpGateway) put(ctx context.Context, w http.ResponseWriter, r *http.Request, name string) error {
+	key, err := g.s.storeKey(ctx, name)
+	if err != nil {
+		return err
+	}
+	name, _ = cleanName(name)
+	expected, err := parseDigest(r.Header.Get(digest_header))
+	if err != nil {
+		return err
+	}
+	contentRange := r.Header.Get("Content-Range")
+	if contentRange == "" {
+		return g.putWhole(ctx, w, r, key, name, expected)
+	}
+	start, end, total, err := parseContentRange(contentRange)
+	if err != nil {
+		return err
+	}
+	if r.ContentLength >= 0 && r.ContentLength != end-start {
+		return status.Errorf(codes.InvalidArgument, "Content-Range covers %d bytes, the body has %d", end-start, r.ContentLength)
+	}
+	return g.putRange(ctx, w, r, key, name, start, end, total, expected)
+}
+
+// putRange writes [start, end) of a file of total bytes into the session
+// of the caller, "bytes */total" only asks how far the session got.
+func (g *httpGateway) putRange(ctx context.Context, w http.ResponseWriter, r *http.Request, key string, name string, start int64, end int64, total int64, expected string) error {
+	s := g.s
+	var (
+		up  *upload
+		err error
+	)
+	replaced := s.replacedSize(key)
+	s.mu.Lock()
+	up = s.findUpload(name, callerIdentity(ctx), total, proto.DigestType_Sha256)
+	if up == nil && start >= 0 {
+		if up, err = s.openUpload(ctx, key, name, total, replaced, proto.DigestType_Sha256, ""); err == nil {
+			s.uploadLogger(ctx, up.id, name).Info("upload opened", "size", total, "digest", proto.DigestType_Sha256)
+		}
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if up == nil {
+		//nothing received yet
+		w.WriteHeader(http_resume_incomplete)
+		return nil
+	}
+
+	log := s.uploadLogger(ctx, up.id, up.name)
+	staged, err := s.storage.OpenStaged(up.id)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		staged.Close()
+		//keep what arrived so far for a resume after a restart
+		if err := s.sessions.save(up); err != nil {
+			log.Warn("save upload failed", "error", err)
+		}
+	}()
+
+	if start >= 0 {
+		log.Debug("request started", "offset", start, "end", end)
+		//one byte more than the range, so a longer body is noticed
+		body := io.LimitReader(r.Body, end-start+1)
+		err = g.copyBody(ctx, up.owner, body, func(p []byte, offset int64) error {
+			if offset+int64(len(p)) > end-start {
+				return status.Error(codes.InvalidArgument, "the body is longer than Content-Range")
+			}
+			log.Debug("chunk", "offset", start+offset, "size", len(p))
+			return up.write(staged, &proto.Chunk{
+				Id:      up.id,
+				Offset:  start + offset,
+				Content: p,
+				Digest:  expected,
+			})
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return g.complete(ctx, w, log, up, staged)
+}
+
+// complete answers a request that wrote to up, committing it once every
+// range is there. A committed upload comes with its sha-256.
+func (g *httpGateway) complete(ctx context.Context, w http.ResponseWriter, log *Logger, up *upload, staged StagedFile) error {
+	result, err := g.s.completeUpload(ctx, log, up, staged)
+	if err != nil {
+		return err
+	}
+	if result.GetCode() == proto.ResultCode_Ok {
+		up.mu.Lock()
+		sum := up.digest.Sum(nil)
+		up.mu.Unlock()
+		w.Header().Set(digest_header, sha256_digest+base64.StdEncoding.EncodeToString(sum))
+	}
+	writeResult(w, result)
+	return nil
+}
+
+// putWhole stores the body as the file. With a length it is the first
+// range of a session as putRange's, so a broken request is resumed with
+// Content-Range. A body without a length grows a session chunk by chunk,
+// which is checked against the limits as it grows and dropped when the
+// body breaks off.
+func (g *httpGateway) putWhole(ctx context.Context, w http.ResponseWriter, r *http.Request, key string, name string, expected string) error {
+	if r.ContentLength >= 0 {
+		return g.putRange(ctx, w, r, key, name, 0, r.ContentLength, r.ContentLength, expected)
+	}
+	s := g.s
+	replaced := s.replacedSize(key)
+	s.mu.Lock()
+	up, err := s.openUpload(ctx, key, name, 0, replaced, proto.DigestType_Sha256, "")
+	if err == nil {
+		up.growing = true
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	s.sessions.remove(up.id)
+	log := s.uploadLogger(ctx, up.id, name)
+	log.Info("upload opened", "size", "unknown", "digest", proto.DigestType_Sha256)
+
+	staged, err := s.storage.OpenStaged(up.id)
+	if err != nil {
+		s.abortUpload(up)
+		return err
+	}
+	defer staged.Close()
+	err = g.copyBody(ctx, up.owner, r.Body, func(p []byte, offset int64) error {
+		log.Debug("chunk", "offset", offset, "size", len(p))
+		if err := s.growUpload(ctx, up, key, int64(len(p)), replaced); err != nil {
+			return err
+		}
+		return up.write(staged, &proto.Chunk{Id: up.id, Offset: offset, Content: p, Digest: expected})
+	})
+	if err != nil {
+		s.abortUpload(up)
+		return err
+	}
+	return g.complete(ctx, w, log, up, staged)
+}
+
+// copyBody hands body to write in chunks, with the offset of each chunk
+// in the body, holding to the upload limits of owner. Only a clean end
+// of the body ends it, a body that breaks off is written up to the break
+// and fails.
+func (g *httpGateway) copyBody(ctx context.Context, owner string, body io.Reader, write func(p []byte, offset int64) error) error {
+	buf := make([]byte, chunk_size)
+	var offset int64
+	for {
+		var (
+			num int
+			err error
+		)
+		for num < len(buf) && err == nil {
+			var n int
+			n, err = body.Read(buf[num:])
+			num += n
+		}
+		if num > 0 {
+			if err := g.s.limits.wait(ctx, owner, num); err != nil {
+				return err
+			}
+			if err := write(buf[:num], offset); err != nil {
+				return err
+			}
+			g.s.metrics.receivedBytes.Add(float64(num))
+			offset += int64(num)
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			//the client went away, a ranged upload keeps what arrived
+			return status.Errorf(codes.Aborted, "reading the body failed: %v", err)
+		}
+	}
+}
+
+func (g *httpGateway) get(ctx context.Context, w http.ResponseWriter, r *http.Request, name string) error {
+	key, err := g.s.storeKey(ctx, name)
+	if err != nil {
+		return err
+	}
+	stored, err := g.s.storage.Open(key)
+	if err != nil {
+		return fileError(err)
+	}
+	defer stored.Close()
+	_, err = serveFile(w, r, stored, path.Base(name))
+	return err
+}
+
+// shared serves the file of a share link, the token is its credential.
+// Every GET that sends part of the file counts as a download, ranges
+// included, a HEAD does not.
+func (g *httpGateway) shared(w http.ResponseWriter, r *http.Request, token string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	err := func() error {
+		id, err := g.s.shares.verify(token)
+		if err != nil {
+			return err
+		}
+		if r.Method == http.MethodHead {
+			link, err := g.s.shares.peek(id)
+			if err != nil {
+				return err
+			}
+			_, err = g.serveShared(w, r, link)
+			return err
+		}
+		link, err := g.s.shares.use(id)
+		if err != nil {
+			return err
+		}
+		sent, err := g.serveShared(w, r, link)
+		if !sent {
+			if err := g.s.shares.release(id); err != nil {
+				g.s.log.Error("giving back share download failed", "share", id, "error", err)
+			}
+			return err
+		}
+		g.s.log.Info("share link used", "share", link.Id, "file", link.Key, "peer", r.RemoteAddr, "uses", link.Uses)
+		return err
+	}()
+	if err != nil {
+		//a bad token is not a login prompt
+		if status.Code(err) == codes.Unauthenticated {
+			err = status.Error(codes.PermissionDenied, status.Convert(err).Message())
+		}
+		writeHTTPError(w, err)
+	}
+}
+
+// serveShared answers with the file of link as an attachment.
+func (g *httpGateway) serveShared(w http.ResponseWriter, r *http.Request, link *shareState) (bool, error) {
+	stored, err := g.s.storage.Open(link.Key)
+	if err != nil {
+		return false, fileError(err)
+	}
+	defer stored.Close()
+	name := path.Base(link.Key)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	return serveFile(w, r, stored, name)
+}
+
+// serveFile answers a GET or HEAD of stored, with ranges. It reports
+// whether any of the file went out, an empty file counts once its
+// response did.
+func serveFile(w http.ResponseWriter, r *http.Request, stored StoredFile, name string) (bool, error) {
+	info := stored.Info()
+	//lets If-Range and If-None-Match tell versions apart
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, info.Size, info.ModTime.UnixNano()))
+	if r.Method == http.MethodHead {
+		digest, _ := newDigest(proto.DigestType_Sha256)
+		if err := digestPrefix(digest, stored, info.Size); err != nil {
+			return false, err
+		}
+		w.Header().Set(digest_header, sha256_digest+base64.StdEncoding.EncodeToString(digest.Sum(nil)))
+	}
+	sent := &sentWriter{ResponseWriter: w}
+	http.ServeContent(sent, r, name, info.ModTime, io.NewSectionReader(stored, 0, info.Size))
+	switch {
+	case r.Method == http.MethodHead:
+		return false, nil
+	case sent.code != http.StatusOK && sent.code != http.StatusPartialContent:
+		return false, nil
+	}
+	return sent.wrote || info.Size == 0 && !sent.failed, nil
+}
+
+// sentWriter notes the status of a response, whether any of its body
+// went out and whether a write failed.
+type sentWriter struct {
+	http.ResponseWriter
+	code   int
+	wrote  bool
+	failed bool
+}
+
+func (w *sentWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *sentWriter) Write(p []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	if n > 0 {
+		w.wrote = true
+	}
+	if err != nil {
+		w.failed = true
+	}
+	return n, err
+}
+
+// writeResult answers an upload: 201 once committed, 308 with the range
+// the server holds while parts are missing and 422 when it was rejected.
+func writeResult(w http.ResponseWriter, result *proto.ChunkResult) {
+	switch result.GetCode() {
+	case proto.ResultCode_Ok:
+		w.WriteHeader(http.StatusCreated)
+	case proto.ResultCode_Unknown:
+		if result.GetOffset() > 0 {
+			w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", result.GetOffset()-1))
+		}
+		w.WriteHeader(http_resume_incomplete)
+	default:
+		http.Error(w, result.GetMessage(), http.StatusUnprocessableEntity)
+	}
+}
+
+// writeHTTPError answers with the HTTP status closest to the grpc code
+// of err.
+func writeHTTPError(w http.ResponseWriter, err error) {
+	st := status.Convert(err)
+	code := http.StatusInternalServerError
+	switch st.Code() {
+	case codes.InvalidArgument:
+		code = http.StatusBadRequest
+	case codes.Unauthenticated:
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		code = http.StatusUnauthorized
+	case codes.PermissionDenied:
+		code = http.StatusForbidden
+	case codes.NotFound:
+		code = http.StatusNotFound
+	case codes.AlreadyExists:
+		code = http.StatusConflict
+	case codes.FailedPrecondition:
+		code = http.StatusPreconditionFailed
+	case codes.ResourceExhausted:
+		code = http.StatusRequestEntityTooLarge
+	case codes.OutOfRange:
+		code = http.StatusRequestedRangeNotSatisfiable
+	case codes.Aborted, codes.Canceled:
+		code = http.StatusBadRequest
+	case codes.Unavailable:
+		code = http.StatusServiceUnavailable
+	}
+	http.Error(w, st.Message(), code)
+}
+
+// parseContentRange reads "bytes start-end/total" into [start, end), a
+// query "bytes */total" has start and end -1.
+func parseContentRange(value string) (int64, int64, int64, error) {
+	invalid := status.Errorf(codes.InvalidArgument, "invalid Content-Range %q, want bytes start-end/total", value)
+	spec := strings.TrimSpace(value)
+	if !strings.HasPrefix(spec, "bytes ") {
+		return 0, 0, 0, invalid
+	}
+	spec = strings.TrimSpace(strings.TrimPrefix(spec, "bytes "))
+	slash := strings.LastIndexByte(spec, '/')
+	if slash < 0 {
+		return 0, 0, 0, invalid
+	}
+	total, err := strconv.ParseInt(spec[slash+1:], 10, 64)
+	if err != nil || total < 0 {
+		return 0, 0, 0, invalid
+	}
+	if spec[:slash] == "*" {
+		return -1, -1, total, nil
+	}
+	dash := strings.IndexByte(spec[:slash], '-')
+	if dash < 0 {
+		return 0, 0, 0, invalid
+	}
+	start, err1 := strconv.ParseInt(spec[:dash], 10, 64)
+	last, err2 := strconv.ParseInt(spec[dash+1:slash], 10, 64)
+	if err1 != nil || err2 != nil || start < 0 || last < start || last >= total {
+		return 0, 0, 0, invalid
+	}
+	return start, last + 1, total, nil
+}
+
+// parseDigest finds the sha-256 value of a Digest header in hex, other
+// algorithms are ignored.
+func parseDigest(value string) (string, error) {
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if len(part) < len(sha256_digest) || !strings.EqualFold(part[:len(sha256_digest)], sha256_digest) {
+			continue
+		}
+		sum, err := base64.StdEncoding.DecodeString(part[len(sha256_digest):])
+		if err != nil || len(sum) != 32 {
+			return "", status.Errorf(codes.InvalidArgument, "invalid sha-256 digest %q", part)
+		}
+		return hex.EncodeToString(sum), nil
+	}
+	return "", nil
+}
+
+// httpAddr is the remote address of a request as a net.Addr.
+type httpAddr string
+
+func (a httpAddr) Network() string {
+	return "tcp"
+}
+
+func (a httpAddr) String() string {
+	return string(a)
+}
@@ -0,0 +1,158 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+)
+
+// gatewayPut sends body to name, chunked when body has no length.
+func (ts *testServer) gatewayPut(t *testing.T, name string, body io.Reader, header http.Header) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPut, "http://"+ts.httpAddr+files_path+name, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return res
+}
+
+// gatewayGet reads name back through the gateway.
+func (ts *testServer) gatewayGet(t *testing.T, name string) (int, []byte) {
+	t.Helper()
+	res, err := http.Get("http://" + ts.httpAddr + files_path + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode, data
+}
+
+// openUploads counts the sessions of the server.
+func (ts *testServer) openUploads() int {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return len(ts.uploads)
+}
+
+func TestGatewayChunkedOverQuota(t *testing.T) {
+	ts := startTestServer(t, WithServerQuota(0, 50<<10))
+	data := randomBytes(1, 64<<10)
+
+	//a reader without Len is sent chunked
+	res := ts.gatewayPut(t, "big.bin", io.MultiReader(bytes.NewReader(data)), nil)
+	if res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status %d, want %d", res.StatusCode, http.StatusRequestEntityTooLarge)
+	}
+	if code, _ := ts.gatewayGet(t, "big.bin"); code != http.StatusNotFound {
+		t.Errorf("get status %d, want %d", code, http.StatusNotFound)
+	}
+	if n := ts.openUploads(); n != 0 {
+		t.Errorf("%d uploads left open", n)
+	}
+
+	small := data[:10<<10]
+	res = ts.gatewayPut(t, "small.bin", io.MultiReader(bytes.NewReader(small)), nil)
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("status %d, want %d", res.StatusCode, http.StatusCreated)
+	}
+	if code, got := ts.gatewayGet(t, "small.bin"); code != http.StatusOK || !bytes.Equal(got, small) {
+		t.Errorf("get status %d with %d bytes, want the %d bytes sent", code, len(got), len(small))
+	}
+}
+
+func TestGatewayChunkedUploadsCountAgainstEachOther(t *testing.T) {
+	ts := startTestServer(t, WithServerQuota(0, 50<<10))
+	data := randomBytes(2, chunk_size)
+
+	body, write := io.Pipe()
+	done := make(chan *http.Response, 1)
+	go func() {
+		req, _ := http.NewRequest(http.MethodPut, "http://"+ts.httpAddr+files_path+"a.bin", body)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error(err)
+			done <- nil
+			return
+		}
+		res.Body.Close()
+		done <- res
+	}()
+	if _, err := write.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the first chunk", func() bool {
+		ts.mu.Lock()
+		defer ts.mu.Unlock()
+		return ts.usage(context.Background()) == int64(chunk_size)
+	})
+
+	res := ts.gatewayPut(t, "b.bin", io.MultiReader(bytes.NewReader(data)), nil)
+	if res.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("second upload status %d, want %d", res.StatusCode, http.StatusRequestEntityTooLarge)
+	}
+
+	write.Close()
+	if res := <-done; res != nil && res.StatusCode != http.StatusCreated {
+		t.Errorf("first upload status %d, want %d", res.StatusCode, http.StatusCreated)
+	}
+}
+
+func TestGatewayResumeBrokenPut(t *testing.T) {
+	ts := startTestServer(t)
+	data := randomBytes(3, 3*chunk_size+100)
+	half := int64(len(data) / 2)
+
+	//the connection breaks off after half of the body
+	conn, err := net.Dial("tcp", ts.httpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(conn, "PUT %sc.bin HTTP/1.1\r\nHost: %s\r\nContent-Length: %d\r\n\r\n", files_path, ts.httpAddr, len(data))
+	if _, err := conn.Write(data[:half]); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	query := http.Header{"Content-Range": {fmt.Sprintf("bytes */%d", len(data))}}
+	want := fmt.Sprintf("bytes=0-%d", half-1)
+	var res *http.Response
+	waitFor(t, "the first half", func() bool {
+		res = ts.gatewayPut(t, "c.bin", http.NoBody, query)
+		return res.Header.Get("Range") == want
+	})
+	if res.StatusCode != http_resume_incomplete {
+		t.Fatalf("status %d, want %d", res.StatusCode, http_resume_incomplete)
+	}
+
+	rest := http.Header{"Content-Range": {fmt.Sprintf("bytes %d-%d/%d", half, len(data)-1, len(data))}}
+	res = ts.gatewayPut(t, "c.bin", bytes.NewReader(data[half:]), rest)
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("status %d, want %d", res.StatusCode, http.StatusCreated)
+	}
+	if res.Header.Get(digest_header) == "" {
+		t.Error("no digest on the committed upload")
+	}
+	if code, got := ts.gatewayGet(t, "c.bin"); code != http.StatusOK || !bytes.Equal(got, data) {
+		t.Errorf("get status %d with %d bytes, want the %d bytes sent", code, len(got), len(data))
+	}
+	if n := ts.openUploads(); n != 0 {
+		t.Errorf("%d uploads left open", n)
+	}
+}
@@ -0,0 +1,78 @@
+package internal
+
+import (
+	"context"
+	"net"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+type identityKey struct{}
+
+// identityUnaryInterceptor resolves who is calling before the handler
+// runs, the handlers read it back with callerIdentity.
+func (s *grpcServer) identityUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	identity := peerIdentity(ctx)
+	s.log.Debug("call", "method", info.FullMethod, "peer", peerAddress(ctx), "user", identity)
+	return handler(context.WithValue(ctx, identityKey{}, identity), req)
+}
+
+func (s *grpcServer) identityStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	identity := peerIdentity(ss.Context())
+	s.log.Debug("call", "method", info.FullMethod, "peer", peerAddress(ss.Context()), "user", identity)
+	return handler(srv, &contextStream{
+		ServerStream: ss,
+		ctx:          context.WithValue(ss.Context(), identityKey{}, identity),
+	})
+}
+
+// contextStream replaces the context of a server stream.
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
+
+// callerIdentity names whoever is on the other end of ctx, a session is
+// only handed back to the identity that opened it.
+func callerIdentity(ctx context.Context) string {
+	if identity, ok := ctx.Value(identityKey{}).(string); ok {
+		return identity
+	}
+	return peerIdentity(ctx)
+}
+
+// peerIdentity is the name of the authenticated user, else the subject
+// of a verified client certificate, else the peer host.
+func peerIdentity(ctx context.Context) string {
+	if u := userFrom(ctx); u != nil {
+		return u.name
+	}
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	if info, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(info.State.VerifiedChains) > 0 {
+		return info.State.VerifiedChains[0][0].Subject.String()
+	}
+	if p.Addr == nil {
+		return ""
+	}
+	if host, _, err := net.SplitHostPort(p.Addr.String()); err == nil {
+		return host
+	}
+	return p.Addr.String()
+}
+
+// peerAddress is the address the call of ctx came from.
+func peerAddress(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+		return p.Addr.String()
+	}
+	return ""
+}
@@ -1,11 +1,38 @@
 package internal
 
+import (
+	"context"
+	"time"
+	"wangweizZZ/go-daily-study/file-transfer/internal/proto"
+)
+
 type Server interface {
 	Start() error
+	// Shutdown stops taking new calls and gives running ones the drain
+	// timeout to finish before they are cut off.
+	Shutdown()
 	Close()
 }
 
 type Client interface {
 	Transfer(string) error
+	TransferDir(dir string, include []string, exclude []string) error
+	TransferFiles(paths []string) []TransferResult
+	// Watch sends the files of dir as they appear or change until ctx
+	// ends.
+	Watch(ctx context.Context, dir string, opts WatchOptions) error
+	Download(remote string, local string) error
+	// DownloadShared writes the file of a share link to local, or to the
+	// name the server sends when local is empty, and returns the path.
+	DownloadShared(token string, local string) (string, error)
+	List(prefix string) ([]*proto.FileStat, error)
+	Stat(name string) (*proto.FileStat, error)
+	Delete(name string) error
+	Rename(from string, to string) error
+	Share(name string, ttl time.Duration, maxDownloads int32) (*proto.ShareLink, error)
+	RevokeShare(id string) error
+	Replication() (*proto.ReplicationStatus, error)
+	SetRateLimit(global int64, perClient int64) (*proto.RateLimit, error)
+	WatchTransfers(interval time.Duration, fn func(*proto.TransferSnapshot) error) error
 	Close()
 }
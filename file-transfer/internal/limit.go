@@ -0,0 +1,185 @@
+package internal
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// limiter is a token bucket counting bytes, it holds at most one second
+// worth of tokens. A rate of zero means unlimited.
+type limiter struct {
+	mu     sync.Mutex
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter(rate int64) *limiter {
+	return &limiter{rate: rate, tokens: float64(rate), last: time.Now()}
+}
+
+func (l *limiter) setRate(rate int64) {
+	l.mu.Lock()
+	l.rate = rate
+	l.tokens = float64(rate)
+	l.last = time.Now()
+	l.mu.Unlock()
+}
+
+// wait blocks until n bytes may pass. Callers take tokens up front and
+// pay off the debt by sleeping, so n may be larger than the bucket.
+func (l *limiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	if l.rate <= 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+	if l.tokens > float64(l.rate) {
+		l.tokens = float64(l.rate)
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	delay := time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// client_limiter_idle is how long the limiter of a client is kept after
+// its last upload, a new one starts with a full bucket just the same.
+const client_limiter_idle time.Duration = time.Minute
+
+// clientLimiter is the limiter of one client and who is using it.
+type clientLimiter struct {
+	*limiter
+	waiting int
+	used    time.Time
+}
+
+// rateLimits caps the upload rate of the whole server and of every
+// single client.
+type rateLimits struct {
+	global *limiter
+
+	mu        sync.Mutex
+	perClient int64
+	clients   map[string]*clientLimiter
+	swept     time.Time
+}
+
+func newRateLimits(global int64, perClient int64) *rateLimits {
+	return &rateLimits{
+		global:    newLimiter(global),
+		perClient: perClient,
+		clients:   make(map[string]*clientLimiter),
+		swept:     time.Now(),
+	}
+}
+
+// set changes the limits, a negative value keeps the current one.
+func (rl *rateLimits) set(global int64, perClient int64) (int64, int64) {
+	if global >= 0 {
+		rl.global.setRate(global)
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if perClient >= 0 {
+		rl.perClient = perClient
+		for _, l := range rl.clients {
+			l.setRate(perClient)
+		}
+	}
+	rl.global.mu.Lock()
+	defer rl.global.mu.Unlock()
+	return rl.global.rate, rl.perClient
+}
+
+func (rl *rateLimits) wait(ctx context.Context, client string, n int) error {
+	now := time.Now()
+	rl.mu.Lock()
+	rl.sweep(now)
+	l, ok := rl.clients[client]
+	if !ok {
+		l = &clientLimiter{limiter: newLimiter(rl.perClient)}
+		rl.clients[client] = l
+	}
+	l.waiting++
+	rl.mu.Unlock()
+
+	err := l.wait(ctx, n)
+	rl.mu.Lock()
+	l.waiting--
+	l.used = time.Now()
+	rl.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return rl.global.wait(ctx, n)
+}
+
+// sweep drops the limiters of clients that have been idle for a while,
+// at most once per client_limiter_idle. The caller holds rl.mu.
+func (rl *rateLimits) sweep(now time.Time) {
+	if now.Sub(rl.swept) < client_limiter_idle {
+		return
+	}
+	rl.swept = now
+	for client, l := range rl.clients {
+		if l.waiting == 0 && now.Sub(l.used) >= client_limiter_idle {
+			delete(rl.clients, client)
+		}
+	}
+}
+
+// ParseRate reads a rate such as "512K", "10MB/s" or "1g" as bytes per
+// second, units are powers of 1024 and "" or "0" mean unlimited.
+func ParseRate(s string) (int64, error) {
+	rate, err := ParseSize(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "/S"))
+	if err != nil {
+		return 0, errors.Errorf("invalid rate %q", s)
+	}
+	return rate, nil
+}
+
+// ParseSize reads a size such as "512K", "16MB" or "1g" in bytes, units
+// are powers of 1024 and "" means zero.
+func ParseSize(s string) (int64, error) {
+	num := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	if num == "" {
+		return 0, nil
+	}
+	var unit int64 = 1
+	switch num[len(num)-1] {
+	case 'K':
+		unit = 1 << 10
+	case 'M':
+		unit = 1 << 20
+	case 'G':
+		unit = 1 << 30
+	}
+	if unit != 1 {
+		num = num[:len(num)-1]
+	}
+	value, err := strconv.ParseFloat(num, 64)
+	if err != nil || value < 0 {
+		return 0, errors.Errorf("invalid size %q", s)
+	}
+	return int64(value * float64(unit)), nil
+}
@@ -0,0 +1,79 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRateLimitsEvictIdle(t *testing.T) {
+	rl := newRateLimits(0, 1<<20)
+	ctx := context.Background()
+	for _, client := range []string{"a", "b", "c"} {
+		if err := rl.wait(ctx, client, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(rl.clients) != 3 {
+		t.Fatalf("%d limiters", len(rl.clients))
+	}
+
+	//a and b went idle, c is still waiting on its limiter
+	past := time.Now().Add(-2 * client_limiter_idle)
+	rl.mu.Lock()
+	rl.swept = past
+	rl.clients["a"].used = past
+	rl.clients["b"].used = past
+	rl.clients["c"].used = past
+	rl.clients["c"].waiting = 1
+	rl.mu.Unlock()
+
+	if err := rl.wait(ctx, "d", 1); err != nil {
+		t.Fatal(err)
+	}
+	for client, want := range map[string]bool{"a": false, "b": false, "c": true, "d": true} {
+		if _, ok := rl.clients[client]; ok != want {
+			t.Errorf("limiter of %s kept %v, want %v", client, ok, want)
+		}
+	}
+}
+
+func TestRateLimitsSweepInterval(t *testing.T) {
+	rl := newRateLimits(0, 1<<20)
+	ctx := context.Background()
+	if err := rl.wait(ctx, "a", 1); err != nil {
+		t.Fatal(err)
+	}
+	//idle but the last sweep was just now
+	rl.clients["a"].used = time.Now().Add(-2 * client_limiter_idle)
+	if err := rl.wait(ctx, "b", 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := rl.clients["a"]; !ok {
+		t.Error("limiter of a dropped before the sweep interval passed")
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+		ok   bool
+	}{
+		{"", 0, true},
+		{"0", 0, true},
+		{"512", 512, true},
+		{"512K", 512 << 10, true},
+		{"16MB", 16 << 20, true},
+		{"1g", 1 << 30, true},
+		{"1.5k", 1536, true},
+		{"-1", 0, false},
+		{"abc", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseSize(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("ParseSize(%q) = %d, %v", tt.in, got, err)
+		}
+	}
+}
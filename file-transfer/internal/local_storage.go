@@ -0,0 +1,180 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var _ Storage = &localStorage{}
+
+// localStorage keeps files below a directory, uploads are staged in its
+// session directory and renamed into place on commit.
+type localStorage struct {
+	root string
+}
+
+// NewLocalStorage keeps files below root.
+func NewLocalStorage(root string) Storage {
+	return &localStorage{root: root}
+}
+
+func (ls *localStorage) stagedPath(id string) string {
+	return filepath.Join(ls.root, session_dir, id+tmp_file_suffix)
+}
+
+// path resolves key below the root, see resolvePath.
+func (ls *localStorage) path(key string) (string, error) {
+	p, err := resolvePath(ls.root, key)
+	if err != nil {
+		return "", errors.Wrap(ErrInvalidKey, err.Error())
+	}
+	return p, nil
+}
+
+func (ls *localStorage) Create(id string) (StagedFile, error) {
+	path := ls.stagedPath(id)
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return nil, err
+	}
+	return os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0666)
+}
+
+func (ls *localStorage) OpenStaged(id string) (StagedFile, error) {
+	return os.OpenFile(ls.stagedPath(id), os.O_RDWR, 0666)
+}
+
+func (ls *localStorage) Commit(id string, key string, size int64) error {
+	dest, err := ls.path(key)
+	if err != nil {
+		return err
+	}
+	staged := ls.stagedPath(id)
+	if err = os.Truncate(staged, size); err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(dest), 0777); err != nil {
+		return err
+	}
+	return os.Rename(staged, dest)
+}
+
+func (ls *localStorage) Abort(id string) error {
+	err := os.Remove(ls.stagedPath(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+type localFile struct {
+	*os.File
+	info FileInfo
+}
+
+func (lf *localFile) Info() FileInfo {
+	return lf.info
+}
+
+func (ls *localStorage) Open(key string) (StoredFile, error) {
+	path, err := ls.path(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		file.Close()
+		return nil, notExist("open", key)
+	}
+	return &localFile{File: file, info: newFileInfo(key, info)}, nil
+}
+
+func (ls *localStorage) Stat(key string) (FileInfo, error) {
+	path, err := ls.path(key)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if !info.Mode().IsRegular() {
+		return FileInfo{}, notExist("stat", key)
+	}
+	return newFileInfo(key, info), nil
+}
+
+func (ls *localStorage) List(prefix string) ([]FileInfo, error) {
+	root := filepath.Clean(ls.root)
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		//nothing uploaded yet
+		return nil, nil
+	}
+
+	var files []FileInfo
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if info.IsDir() {
+			if key == session_dir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode().IsRegular() && strings.HasPrefix(key, prefix) {
+			files = append(files, newFileInfo(key, info))
+		}
+		return nil
+	})
+	return files, err
+}
+
+func (ls *localStorage) Delete(key string) error {
+	if _, err := ls.Stat(key); err != nil {
+		return err
+	}
+	path, _ := ls.path(key)
+	return os.Remove(path)
+}
+
+func (ls *localStorage) Rename(from string, to string) error {
+	if _, err := ls.Stat(from); err != nil {
+		return err
+	}
+	src, _ := ls.path(from)
+	dest, err := ls.path(to)
+	if err != nil {
+		return err
+	}
+	if _, err = os.Lstat(dest); err == nil {
+		return &os.PathError{Op: "rename", Path: to, Err: os.ErrExist}
+	}
+	if err = os.MkdirAll(filepath.Dir(dest), 0777); err != nil {
+		return err
+	}
+	return os.Rename(src, dest)
+}
+
+func newFileInfo(key string, info os.FileInfo) FileInfo {
+	return FileInfo{
+		Name:    key,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}
+}
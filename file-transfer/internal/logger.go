@@ -0,0 +1,166 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const log_time_format = "2006-01-02T15:04:05.000Z07:00"
+
+// Level orders records by importance, a Logger drops records below its
+// level.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	default:
+		return "error"
+	}
+}
+
+// logOutput is shared by a logger and every logger derived from it.
+type logOutput struct {
+	mu    sync.Mutex
+	w     io.Writer
+	json  bool
+	level Level
+}
+
+// Logger writes leveled records with key value fields, as key=value text
+// or one JSON object per line. Loggers made by With write to the output
+// of their parent.
+type Logger struct {
+	out    *logOutput
+	fields []interface{}
+}
+
+// NewLogger writes records of level and above to w.
+func NewLogger(w io.Writer, json bool, level Level) *Logger {
+	return &Logger{out: &logOutput{w: w, json: json, level: level}}
+}
+
+// defaultLogger is used when no logger is given, text on stderr like the
+// log package.
+var defaultLogger = NewLogger(os.Stderr, false, LevelInfo)
+
+// With returns a logger that adds the key value pairs kv to every
+// record.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(append(fields, l.fields...), kv...)
+	return &Logger{out: l.out, fields: fields}
+}
+
+// Enabled reports whether records of level are written, so costly
+// fields can be skipped.
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.out.level
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) {
+	l.log(LevelDebug, msg, kv)
+}
+
+func (l *Logger) Info(msg string, kv ...interface{}) {
+	l.log(LevelInfo, msg, kv)
+}
+
+func (l *Logger) Warn(msg string, kv ...interface{}) {
+	l.log(LevelWarn, msg, kv)
+}
+
+func (l *Logger) Error(msg string, kv ...interface{}) {
+	l.log(LevelError, msg, kv)
+}
+
+func (l *Logger) log(level Level, msg string, kv []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	fields := make([]interface{}, 0, 6+len(l.fields)+len(kv))
+	fields = append(fields, "time", time.Now().Format(log_time_format), "level", level.String(), "msg", msg)
+	fields = append(append(fields, l.fields...), kv...)
+	if len(fields)%2 != 0 {
+		fields = append(fields, "(missing)")
+	}
+
+	var buf bytes.Buffer
+	if l.out.json {
+		writeJSONRecord(&buf, fields)
+	} else {
+		writeTextRecord(&buf, fields)
+	}
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	l.out.w.Write(buf.Bytes())
+}
+
+func writeTextRecord(buf *bytes.Buffer, fields []interface{}) {
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(fmt.Sprint(fields[i]))
+		buf.WriteByte('=')
+		value := fmt.Sprint(logValue(fields[i+1]))
+		if value == "" || strings.ContainsAny(value, " =\"\\\t\r\n") {
+			value = strconv.Quote(value)
+		}
+		buf.WriteString(value)
+	}
+	buf.WriteByte('\n')
+}
+
+func writeJSONRecord(buf *bytes.Buffer, fields []interface{}) {
+	buf.WriteByte('{')
+	for i := 0; i < len(fields); i += 2 {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(fmt.Sprint(fields[i]))
+		buf.Write(key)
+		buf.WriteByte(':')
+		value := logValue(fields[i+1])
+		data, err := json.Marshal(value)
+		if err != nil {
+			data, _ = json.Marshal(fmt.Sprint(value))
+		}
+		buf.Write(data)
+	}
+	buf.WriteString("}\n")
+}
+
+// logValue turns values without a useful plain form, such as errors and
+// durations, into strings.
+func logValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case time.Time:
+		return v.Format(log_time_format)
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return v
+	}
+}
@@ -0,0 +1,68 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"wangweizZZ/go-daily-study/file-transfer/internal/proto"
+)
+
+// buildManifest walks dir and describes every regular file accepted by
+// the include and exclude patterns. It also returns the local path of
+// each entry keyed by its name.
+func buildManifest(dir string, include []string, exclude []string, digestType proto.DigestType) ([]*proto.ManifestEntry, map[string]string, error) {
+	var entries []*proto.ManifestEntry
+	paths := make(map[string]string)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if info.IsDir() {
+			if name != "." && matchAny(exclude, name) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !info.Mode().IsRegular() || matchAny(exclude, name) {
+			return nil
+		}
+		if len(include) > 0 && !matchAny(include, name) {
+			return nil
+		}
+
+		digest, err := fileDigest(path, digestType)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, &proto.ManifestEntry{
+			Name:   name,
+			Size:   info.Size(),
+			Digest: digest,
+		})
+		paths[name] = path
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return entries, paths, nil
+}
+
+// matchAny reports whether any pattern matches either the whole name
+// or its last element, so "*.log" works at every depth.
+func matchAny(patterns []string, name string) bool {
+	base := filepath.Base(name)
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(pattern, base); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,176 @@
+package internal
+
+import (
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var _ Storage = &memoryStorage{}
+
+// memoryStorage keeps everything in memory, it is gone with the server.
+type memoryStorage struct {
+	mu     sync.Mutex
+	staged map[string]*memoryFile
+	files  map[string]*memoryFile
+}
+
+// NewMemoryStorage keeps files in memory, for tests and throwaway
+// servers.
+func NewMemoryStorage() Storage {
+	return &memoryStorage{
+		staged: make(map[string]*memoryFile),
+		files:  make(map[string]*memoryFile),
+	}
+}
+
+// memoryFile is staged data while it is written, committed files get a
+// copy of their own that never changes.
+type memoryFile struct {
+	mu   sync.RWMutex
+	data []byte
+	info FileInfo
+}
+
+func (f *memoryFile) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if end := off + int64(len(p)); end > int64(len(f.data)) {
+		f.data = append(f.data, make([]byte, end-int64(len(f.data)))...)
+	}
+	return copy(f.data[off:], p), nil
+}
+
+func (f *memoryFile) ReadAt(p []byte, off int64) (int, error) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	if off >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memoryFile) Close() error {
+	return nil
+}
+
+func (f *memoryFile) Info() FileInfo {
+	return f.info
+}
+
+func (ms *memoryStorage) Create(id string) (StagedFile, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	f := &memoryFile{}
+	ms.staged[id] = f
+	return f, nil
+}
+
+func (ms *memoryStorage) OpenStaged(id string) (StagedFile, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	f, ok := ms.staged[id]
+	if !ok {
+		return nil, notExist("open", id)
+	}
+	return f, nil
+}
+
+func (ms *memoryStorage) Commit(id string, key string, size int64) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	staged, ok := ms.staged[id]
+	if !ok {
+		return notExist("commit", id)
+	}
+	//streams still holding the staged file must not change the result
+	data := make([]byte, size)
+	staged.mu.RLock()
+	copy(data, staged.data)
+	staged.mu.RUnlock()
+
+	delete(ms.staged, id)
+	ms.files[key] = &memoryFile{
+		data: data,
+		info: FileInfo{Name: key, Size: size, ModTime: time.Now()},
+	}
+	return nil
+}
+
+func (ms *memoryStorage) Abort(id string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.staged, id)
+	return nil
+}
+
+func (ms *memoryStorage) Open(key string) (StoredFile, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	f, ok := ms.files[key]
+	if !ok {
+		return nil, notExist("open", key)
+	}
+	return f, nil
+}
+
+func (ms *memoryStorage) Stat(key string) (FileInfo, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	f, ok := ms.files[key]
+	if !ok {
+		return FileInfo{}, notExist("stat", key)
+	}
+	return f.info, nil
+}
+
+func (ms *memoryStorage) List(prefix string) ([]FileInfo, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	var files []FileInfo
+	for key, f := range ms.files {
+		if strings.HasPrefix(key, prefix) {
+			files = append(files, f.info)
+		}
+	}
+	return files, nil
+}
+
+func (ms *memoryStorage) Delete(key string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if _, ok := ms.files[key]; !ok {
+		return notExist("delete", key)
+	}
+	delete(ms.files, key)
+	return nil
+}
+
+func (ms *memoryStorage) Rename(from string, to string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	f, ok := ms.files[from]
+	if !ok {
+		return notExist("rename", from)
+	}
+	if _, ok = ms.files[to]; ok {
+		return &os.PathError{Op: "rename", Path: to, Err: os.ErrExist}
+	}
+	delete(ms.files, from)
+	info := f.info
+	info.Name = to
+	ms.files[to] = &memoryFile{data: f.data, info: info}
+	return nil
+}
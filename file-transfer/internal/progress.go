@@ -0,0 +1,92 @@
+package internal
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// Progress describes an upload in flight, it is handed to the callback
+// set with WithProgress after every chunk.
+type Progress struct {
+	Name string
+	// Done counts the bytes the server has, including the part a resumed
+	// upload did not have to send again.
+	Done    int64
+	Total   int64
+	Resumed int64
+	Started time.Time
+}
+
+// Rate is the average upload speed in bytes per second.
+func (p Progress) Rate() float64 {
+	elapsed := time.Since(p.Started).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(p.Done-p.Resumed) / elapsed
+}
+
+// ETA estimates the time left at the current rate, zero if unknown.
+func (p Progress) ETA() time.Duration {
+	rate := p.Rate()
+	if rate <= 0 {
+		return 0
+	}
+	return time.Duration(float64(p.Total-p.Done) / rate * float64(time.Second))
+}
+
+// progressTracker adds up what the streams of one upload have read and
+// reports it, it is safe for concurrent use.
+type progressTracker struct {
+	mu       sync.Mutex
+	progress Progress
+	report   func(Progress)
+}
+
+// newProgressTracker returns nil when nobody listens, a nil tracker
+// passes readers through untouched.
+func newProgressTracker(name string, total int64, resumed int64, report func(Progress)) *progressTracker {
+	if report == nil {
+		return nil
+	}
+	t := &progressTracker{
+		progress: Progress{
+			Name:    name,
+			Done:    resumed,
+			Total:   total,
+			Resumed: resumed,
+			Started: time.Now(),
+		},
+		report: report,
+	}
+	report(t.progress)
+	return t
+}
+
+func (t *progressTracker) add(n int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.progress.Done += int64(n)
+	t.report(t.progress)
+}
+
+func (t *progressTracker) reader(r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+	return &progressReader{r: r, t: t}
+}
+
+type progressReader struct {
+	r io.Reader
+	t *progressTracker
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	if n > 0 {
+		pr.t.add(n)
+	}
+	return n, err
+}
@@ -7,6 +7,7 @@ import (
 	grpc "google.golang.org/grpc"
 	codes "google.golang.org/grpc/codes"
 	status "google.golang.org/grpc/status"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
 )
 
 // This is a compile-time assertion to ensure that this generated file
@@ -20,6 +21,22 @@ const _ = grpc.SupportPackageIsVersion7
 type TransferServiceClient interface {
 	Open(ctx context.Context, in *FileInfo, opts ...grpc.CallOption) (*FileInfoResult, error)
 	Write(ctx context.Context, opts ...grpc.CallOption) (TransferService_WriteClient, error)
+	Read(ctx context.Context, in *FileRequest, opts ...grpc.CallOption) (TransferService_ReadClient, error)
+	Manifest(ctx context.Context, in *ManifestRequest, opts ...grpc.CallOption) (*ManifestResult, error)
+	List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (*ListResult, error)
+	Stat(ctx context.Context, in *StatRequest, opts ...grpc.CallOption) (*FileStat, error)
+	Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	Rename(ctx context.Context, in *RenameRequest, opts ...grpc.CallOption) (*FileStat, error)
+	Signatures(ctx context.Context, in *SignatureRequest, opts ...grpc.CallOption) (TransferService_SignaturesClient, error)
+	Patch(ctx context.Context, opts ...grpc.CallOption) (TransferService_PatchClient, error)
+	Share(ctx context.Context, in *ShareRequest, opts ...grpc.CallOption) (*ShareLink, error)
+	// needs no credentials, the share token is checked instead
+	ReadShared(ctx context.Context, in *SharedFileRequest, opts ...grpc.CallOption) (TransferService_ReadSharedClient, error)
+	// admin only
+	SetRateLimit(ctx context.Context, in *RateLimit, opts ...grpc.CallOption) (*RateLimit, error)
+	WatchTransfers(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (TransferService_WatchTransfersClient, error)
+	RevokeShare(ctx context.Context, in *RevokeShareRequest, opts ...grpc.CallOption) (*emptypb.Empty, error)
+	Replication(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*ReplicationStatus, error)
 }
 
 type transferServiceClient struct {
@@ -73,12 +90,271 @@ func (x *transferServiceWriteClient) CloseAndRecv() (*ChunkResult, error) {
 	return m, nil
 }
 
+func (c *transferServiceClient) Read(ctx context.Context, in *FileRequest, opts ...grpc.CallOption) (TransferService_ReadClient, error) {
+	stream, err := c.cc.NewStream(ctx, &TransferService_ServiceDesc.Streams[1], "/TransferService/Read", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &transferServiceReadClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type TransferService_ReadClient interface {
+	Recv() (*Chunk, error)
+	grpc.ClientStream
+}
+
+type transferServiceReadClient struct {
+	grpc.ClientStream
+}
+
+func (x *transferServiceReadClient) Recv() (*Chunk, error) {
+	m := new(Chunk)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *transferServiceClient) Manifest(ctx context.Context, in *ManifestRequest, opts ...grpc.CallOption) (*ManifestResult, error) {
+	out := new(ManifestResult)
+	err := c.cc.Invoke(ctx, "/TransferService/Manifest", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *transferServiceClient) List(ctx context.Context, in *ListRequest, opts ...grpc.CallOption) (*ListResult, error) {
+	out := new(ListResult)
+	err := c.cc.Invoke(ctx, "/TransferService/List", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *transferServiceClient) Stat(ctx context.Context, in *StatRequest, opts ...grpc.CallOption) (*FileStat, error) {
+	out := new(FileStat)
+	err := c.cc.Invoke(ctx, "/TransferService/Stat", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *transferServiceClient) Delete(ctx context.Context, in *DeleteRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, "/TransferService/Delete", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *transferServiceClient) Rename(ctx context.Context, in *RenameRequest, opts ...grpc.CallOption) (*FileStat, error) {
+	out := new(FileStat)
+	err := c.cc.Invoke(ctx, "/TransferService/Rename", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *transferServiceClient) Signatures(ctx context.Context, in *SignatureRequest, opts ...grpc.CallOption) (TransferService_SignaturesClient, error) {
+	stream, err := c.cc.NewStream(ctx, &TransferService_ServiceDesc.Streams[2], "/TransferService/Signatures", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &transferServiceSignaturesClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type TransferService_SignaturesClient interface {
+	Recv() (*SignatureBatch, error)
+	grpc.ClientStream
+}
+
+type transferServiceSignaturesClient struct {
+	grpc.ClientStream
+}
+
+func (x *transferServiceSignaturesClient) Recv() (*SignatureBatch, error) {
+	m := new(SignatureBatch)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *transferServiceClient) Patch(ctx context.Context, opts ...grpc.CallOption) (TransferService_PatchClient, error) {
+	stream, err := c.cc.NewStream(ctx, &TransferService_ServiceDesc.Streams[3], "/TransferService/Patch", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &transferServicePatchClient{stream}
+	return x, nil
+}
+
+type TransferService_PatchClient interface {
+	Send(*DeltaOp) error
+	CloseAndRecv() (*ChunkResult, error)
+	grpc.ClientStream
+}
+
+type transferServicePatchClient struct {
+	grpc.ClientStream
+}
+
+func (x *transferServicePatchClient) Send(m *DeltaOp) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *transferServicePatchClient) CloseAndRecv() (*ChunkResult, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(ChunkResult)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *transferServiceClient) Share(ctx context.Context, in *ShareRequest, opts ...grpc.CallOption) (*ShareLink, error) {
+	out := new(ShareLink)
+	err := c.cc.Invoke(ctx, "/TransferService/Share", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *transferServiceClient) ReadShared(ctx context.Context, in *SharedFileRequest, opts ...grpc.CallOption) (TransferService_ReadSharedClient, error) {
+	stream, err := c.cc.NewStream(ctx, &TransferService_ServiceDesc.Streams[4], "/TransferService/ReadShared", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &transferServiceReadSharedClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type TransferService_ReadSharedClient interface {
+	Recv() (*Chunk, error)
+	grpc.ClientStream
+}
+
+type transferServiceReadSharedClient struct {
+	grpc.ClientStream
+}
+
+func (x *transferServiceReadSharedClient) Recv() (*Chunk, error) {
+	m := new(Chunk)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *transferServiceClient) SetRateLimit(ctx context.Context, in *RateLimit, opts ...grpc.CallOption) (*RateLimit, error) {
+	out := new(RateLimit)
+	err := c.cc.Invoke(ctx, "/TransferService/SetRateLimit", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *transferServiceClient) WatchTransfers(ctx context.Context, in *WatchRequest, opts ...grpc.CallOption) (TransferService_WatchTransfersClient, error) {
+	stream, err := c.cc.NewStream(ctx, &TransferService_ServiceDesc.Streams[5], "/TransferService/WatchTransfers", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &transferServiceWatchTransfersClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type TransferService_WatchTransfersClient interface {
+	Recv() (*TransferSnapshot, error)
+	grpc.ClientStream
+}
+
+type transferServiceWatchTransfersClient struct {
+	grpc.ClientStream
+}
+
+func (x *transferServiceWatchTransfersClient) Recv() (*TransferSnapshot, error) {
+	m := new(TransferSnapshot)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *transferServiceClient) RevokeShare(ctx context.Context, in *RevokeShareRequest, opts ...grpc.CallOption) (*emptypb.Empty, error) {
+	out := new(emptypb.Empty)
+	err := c.cc.Invoke(ctx, "/TransferService/RevokeShare", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *transferServiceClient) Replication(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*ReplicationStatus, error) {
+	out := new(ReplicationStatus)
+	err := c.cc.Invoke(ctx, "/TransferService/Replication", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // TransferServiceServer is the server API for TransferService service.
 // All implementations must embed UnimplementedTransferServiceServer
 // for forward compatibility
 type TransferServiceServer interface {
 	Open(context.Context, *FileInfo) (*FileInfoResult, error)
 	Write(TransferService_WriteServer) error
+	Read(*FileRequest, TransferService_ReadServer) error
+	Manifest(context.Context, *ManifestRequest) (*ManifestResult, error)
+	List(context.Context, *ListRequest) (*ListResult, error)
+	Stat(context.Context, *StatRequest) (*FileStat, error)
+	Delete(context.Context, *DeleteRequest) (*emptypb.Empty, error)
+	Rename(context.Context, *RenameRequest) (*FileStat, error)
+	Signatures(*SignatureRequest, TransferService_SignaturesServer) error
+	Patch(TransferService_PatchServer) error
+	Share(context.Context, *ShareRequest) (*ShareLink, error)
+	// needs no credentials, the share token is checked instead
+	ReadShared(*SharedFileRequest, TransferService_ReadSharedServer) error
+	// admin only
+	SetRateLimit(context.Context, *RateLimit) (*RateLimit, error)
+	WatchTransfers(*WatchRequest, TransferService_WatchTransfersServer) error
+	RevokeShare(context.Context, *RevokeShareRequest) (*emptypb.Empty, error)
+	Replication(context.Context, *emptypb.Empty) (*ReplicationStatus, error)
 	mustEmbedUnimplementedTransferServiceServer()
 }
 
@@ -92,6 +368,48 @@ func (UnimplementedTransferServiceServer) Open(context.Context, *FileInfo) (*Fil
 func (UnimplementedTransferServiceServer) Write(TransferService_WriteServer) error {
 	return status.Errorf(codes.Unimplemented, "method Write not implemented")
 }
+func (UnimplementedTransferServiceServer) Read(*FileRequest, TransferService_ReadServer) error {
+	return status.Errorf(codes.Unimplemented, "method Read not implemented")
+}
+func (UnimplementedTransferServiceServer) Manifest(context.Context, *ManifestRequest) (*ManifestResult, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Manifest not implemented")
+}
+func (UnimplementedTransferServiceServer) List(context.Context, *ListRequest) (*ListResult, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method List not implemented")
+}
+func (UnimplementedTransferServiceServer) Stat(context.Context, *StatRequest) (*FileStat, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Stat not implemented")
+}
+func (UnimplementedTransferServiceServer) Delete(context.Context, *DeleteRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Delete not implemented")
+}
+func (UnimplementedTransferServiceServer) Rename(context.Context, *RenameRequest) (*FileStat, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Rename not implemented")
+}
+func (UnimplementedTransferServiceServer) Signatures(*SignatureRequest, TransferService_SignaturesServer) error {
+	return status.Errorf(codes.Unimplemented, "method Signatures not implemented")
+}
+func (UnimplementedTransferServiceServer) Patch(TransferService_PatchServer) error {
+	return status.Errorf(codes.Unimplemented, "method Patch not implemented")
+}
+func (UnimplementedTransferServiceServer) Share(context.Context, *ShareRequest) (*ShareLink, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Share not implemented")
+}
+func (UnimplementedTransferServiceServer) ReadShared(*SharedFileRequest, TransferService_ReadSharedServer) error {
+	return status.Errorf(codes.Unimplemented, "method ReadShared not implemented")
+}
+func (UnimplementedTransferServiceServer) SetRateLimit(context.Context, *RateLimit) (*RateLimit, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SetRateLimit not implemented")
+}
+func (UnimplementedTransferServiceServer) WatchTransfers(*WatchRequest, TransferService_WatchTransfersServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchTransfers not implemented")
+}
+func (UnimplementedTransferServiceServer) RevokeShare(context.Context, *RevokeShareRequest) (*emptypb.Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RevokeShare not implemented")
+}
+func (UnimplementedTransferServiceServer) Replication(context.Context, *emptypb.Empty) (*ReplicationStatus, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Replication not implemented")
+}
 func (UnimplementedTransferServiceServer) mustEmbedUnimplementedTransferServiceServer() {}
 
 // UnsafeTransferServiceServer may be embedded to opt out of forward compatibility for this service.
@@ -149,6 +467,278 @@ func (x *transferServiceWriteServer) Recv() (*Chunk, error) {
 	return m, nil
 }
 
+func _TransferService_Read_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(FileRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(TransferServiceServer).Read(m, &transferServiceReadServer{stream})
+}
+
+type TransferService_ReadServer interface {
+	Send(*Chunk) error
+	grpc.ServerStream
+}
+
+type transferServiceReadServer struct {
+	grpc.ServerStream
+}
+
+func (x *transferServiceReadServer) Send(m *Chunk) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _TransferService_Manifest_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ManifestRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TransferServiceServer).Manifest(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/TransferService/Manifest",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TransferServiceServer).Manifest(ctx, req.(*ManifestRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _TransferService_List_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TransferServiceServer).List(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/TransferService/List",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TransferServiceServer).List(ctx, req.(*ListRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _TransferService_Stat_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(StatRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TransferServiceServer).Stat(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/TransferService/Stat",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TransferServiceServer).Stat(ctx, req.(*StatRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _TransferService_Delete_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TransferServiceServer).Delete(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/TransferService/Delete",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TransferServiceServer).Delete(ctx, req.(*DeleteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _TransferService_Rename_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RenameRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TransferServiceServer).Rename(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/TransferService/Rename",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TransferServiceServer).Rename(ctx, req.(*RenameRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _TransferService_Signatures_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SignatureRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(TransferServiceServer).Signatures(m, &transferServiceSignaturesServer{stream})
+}
+
+type TransferService_SignaturesServer interface {
+	Send(*SignatureBatch) error
+	grpc.ServerStream
+}
+
+type transferServiceSignaturesServer struct {
+	grpc.ServerStream
+}
+
+func (x *transferServiceSignaturesServer) Send(m *SignatureBatch) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _TransferService_Patch_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(TransferServiceServer).Patch(&transferServicePatchServer{stream})
+}
+
+type TransferService_PatchServer interface {
+	SendAndClose(*ChunkResult) error
+	Recv() (*DeltaOp, error)
+	grpc.ServerStream
+}
+
+type transferServicePatchServer struct {
+	grpc.ServerStream
+}
+
+func (x *transferServicePatchServer) SendAndClose(m *ChunkResult) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *transferServicePatchServer) Recv() (*DeltaOp, error) {
+	m := new(DeltaOp)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _TransferService_Share_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ShareRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TransferServiceServer).Share(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/TransferService/Share",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TransferServiceServer).Share(ctx, req.(*ShareRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _TransferService_ReadShared_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SharedFileRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(TransferServiceServer).ReadShared(m, &transferServiceReadSharedServer{stream})
+}
+
+type TransferService_ReadSharedServer interface {
+	Send(*Chunk) error
+	grpc.ServerStream
+}
+
+type transferServiceReadSharedServer struct {
+	grpc.ServerStream
+}
+
+func (x *transferServiceReadSharedServer) Send(m *Chunk) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _TransferService_SetRateLimit_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RateLimit)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TransferServiceServer).SetRateLimit(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/TransferService/SetRateLimit",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TransferServiceServer).SetRateLimit(ctx, req.(*RateLimit))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _TransferService_WatchTransfers_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(TransferServiceServer).WatchTransfers(m, &transferServiceWatchTransfersServer{stream})
+}
+
+type TransferService_WatchTransfersServer interface {
+	Send(*TransferSnapshot) error
+	grpc.ServerStream
+}
+
+type transferServiceWatchTransfersServer struct {
+	grpc.ServerStream
+}
+
+func (x *transferServiceWatchTransfersServer) Send(m *TransferSnapshot) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _TransferService_RevokeShare_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RevokeShareRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TransferServiceServer).RevokeShare(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/TransferService/RevokeShare",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TransferServiceServer).RevokeShare(ctx, req.(*RevokeShareRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _TransferService_Replication_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TransferServiceServer).Replication(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/TransferService/Replication",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TransferServiceServer).Replication(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // TransferService_ServiceDesc is the grpc.ServiceDesc for TransferService service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -160,6 +750,42 @@ var TransferService_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "Open",
 			Handler:    _TransferService_Open_Handler,
 		},
+		{
+			MethodName: "Manifest",
+			Handler:    _TransferService_Manifest_Handler,
+		},
+		{
+			MethodName: "List",
+			Handler:    _TransferService_List_Handler,
+		},
+		{
+			MethodName: "Stat",
+			Handler:    _TransferService_Stat_Handler,
+		},
+		{
+			MethodName: "Delete",
+			Handler:    _TransferService_Delete_Handler,
+		},
+		{
+			MethodName: "Rename",
+			Handler:    _TransferService_Rename_Handler,
+		},
+		{
+			MethodName: "Share",
+			Handler:    _TransferService_Share_Handler,
+		},
+		{
+			MethodName: "SetRateLimit",
+			Handler:    _TransferService_SetRateLimit_Handler,
+		},
+		{
+			MethodName: "RevokeShare",
+			Handler:    _TransferService_RevokeShare_Handler,
+		},
+		{
+			MethodName: "Replication",
+			Handler:    _TransferService_Replication_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
 		{
@@ -167,6 +793,31 @@ var TransferService_ServiceDesc = grpc.ServiceDesc{
 			Handler:       _TransferService_Write_Handler,
 			ClientStreams: true,
 		},
+		{
+			StreamName:    "Read",
+			Handler:       _TransferService_Read_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Signatures",
+			Handler:       _TransferService_Signatures_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Patch",
+			Handler:       _TransferService_Patch_Handler,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "ReadShared",
+			Handler:       _TransferService_ReadShared_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "WatchTransfers",
+			Handler:       _TransferService_WatchTransfers_Handler,
+			ServerStreams: true,
+		},
 	},
 	Metadata: "internal/proto/service.proto",
 }
@@ -0,0 +1,249 @@
+package internal
+
+import (
+	"context"
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// spaceReporter is implemented by storages that can tell how much room
+// is left for new uploads.
+type spaceReporter interface {
+	FreeSpace() (int64, error)
+}
+
+// usageStorage counts the bytes stored per user as files are committed,
+// deleted and renamed, so quotas are checked without listing the
+// storage. The storage is listed once when the server starts, files
+// changed behind the back of the server are not seen until a restart.
+type usageStorage struct {
+	Storage
+
+	mu    sync.Mutex
+	total int64
+	// users is keyed by the first element of the keys, the directory
+	// of a user
+	users map[string]int64
+}
+
+func newUsageStorage(storage Storage) (*usageStorage, error) {
+	files, err := storage.List("")
+	if err != nil {
+		return nil, err
+	}
+	us := &usageStorage{Storage: storage, users: make(map[string]int64)}
+	for _, f := range files {
+		us.add(f.Name, f.Size)
+	}
+	return us, nil
+}
+
+// add counts n more bytes at key.
+func (us *usageStorage) add(key string, n int64) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	us.total += n
+	if i := strings.IndexByte(key, '/'); i > 0 {
+		us.users[key[:i+1]] += n
+	}
+}
+
+// used is what the files with keys starting with prefix take, prefix is
+// empty or the directory of a user.
+func (us *usageStorage) used(prefix string) int64 {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	if prefix == "" {
+		return us.total
+	}
+	return us.users[prefix]
+}
+
+// size is what the file at key takes, zero when there is none.
+func (us *usageStorage) size(key string) int64 {
+	info, err := us.Storage.Stat(key)
+	if err != nil {
+		return 0
+	}
+	return info.Size
+}
+
+func (us *usageStorage) Commit(id string, key string, size int64) error {
+	replaced := us.size(key)
+	if err := us.Storage.Commit(id, key, size); err != nil {
+		return err
+	}
+	us.add(key, size-replaced)
+	return nil
+}
+
+func (us *usageStorage) Delete(key string) error {
+	size := us.size(key)
+	if err := us.Storage.Delete(key); err != nil {
+		return err
+	}
+	us.add(key, -size)
+	return nil
+}
+
+func (us *usageStorage) Rename(from string, to string) error {
+	size := us.size(from)
+	if err := us.Storage.Rename(from, to); err != nil {
+		return err
+	}
+	us.add(from, -size)
+	us.add(to, size)
+	return nil
+}
+
+// FreeSpace passes the free space of the storage on, storages that can
+// not tell are taken as unlimited.
+func (us *usageStorage) FreeSpace() (int64, error) {
+	if reporter, ok := us.Storage.(spaceReporter); ok {
+		return reporter.FreeSpace()
+	}
+	return math.MaxInt64, nil
+}
+
+// replacedSize is what the file at key takes now, an upload to key frees
+// it on commit. It is looked up before s.mu is taken.
+func (s *grpcServer) replacedSize(key string) int64 {
+	if us, ok := s.storage.(*usageStorage); ok {
+		return us.size(key)
+	}
+	return 0
+}
+
+// admit checks a new upload of size bytes to key against the per file
+// limit, the quota of the caller and the free space of the storage.
+// replaced is the size of the file at key, see replacedSize. The caller
+// holds s.mu, so concurrent opens can not overbook.
+func (s *grpcServer) admit(ctx context.Context, key string, size int64, replaced int64) error {
+	if err := s.admitSize(ctx, key, size, replaced); err != nil {
+		return err
+	}
+	return s.admitSpace(size)
+}
+
+// admitSize is admit without the free space of the storage.
+func (s *grpcServer) admitSize(ctx context.Context, key string, size int64, replaced int64) error {
+	sc := s.config
+	if sc.maxFileSize > 0 && size > sc.maxFileSize {
+		s.metrics.failures.WithLabelValues(failure_size_limit).Inc()
+		return status.Errorf(codes.ResourceExhausted, "%d bytes is over the limit of %d bytes per file", size, sc.maxFileSize)
+	}
+	//the server a replica pushes for checked its quota already
+	if sc.quota > 0 && !replicaPush(ctx) {
+		used := s.usage(ctx) - replaced
+		if used+size > sc.quota {
+			s.metrics.failures.WithLabelValues(failure_quota).Inc()
+			return status.Errorf(codes.ResourceExhausted, "quota of %d bytes exceeded, %d in use", sc.quota, used)
+		}
+	}
+	return nil
+}
+
+// growUpload makes room for n more bytes of a growing upload to key.
+// The upload counts in the usage already, so it is checked as replacing
+// what it holds so far too.
+func (s *grpcServer) growUpload(ctx context.Context, up *upload, key string, n int64, replaced int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	size := up.size
+	if err := s.admitSize(ctx, key, size+n, replaced+size); err != nil {
+		return err
+	}
+	if err := s.admitSpace(n); err != nil {
+		return err
+	}
+	//readers hold either lock
+	up.mu.Lock()
+	up.size += n
+	up.mu.Unlock()
+	return nil
+}
+
+// admitSpace checks that the storage has room for size more bytes. The
+// caller holds s.mu.
+func (s *grpcServer) admitSpace(size int64) error {
+	if reporter, ok := s.storage.(spaceReporter); ok {
+		free, err := reporter.FreeSpace()
+		if err != nil {
+			return err
+		}
+		//open uploads will still take what they have not received
+		if pending := s.pendingBytes(); size+pending > free {
+			s.metrics.failures.WithLabelValues(failure_disk_space).Inc()
+			return status.Errorf(codes.ResourceExhausted, "not enough space in the store, %d bytes free and %d promised to open uploads", free, pending)
+		}
+	}
+	return nil
+}
+
+// reservation holds the room of a write that is no upload session, such
+// as a patch, in the usage of its owner until it ends.
+type reservation struct {
+	owner string
+	size  int64
+	// written is updated atomically as the write goes on
+	written int64
+}
+
+// reserve admits size bytes to key like openUpload does and holds them
+// under id until release. The caller holds s.mu.
+func (s *grpcServer) reserve(ctx context.Context, id string, key string, size int64, replaced int64) (*reservation, error) {
+	if err := s.admit(ctx, key, size, replaced); err != nil {
+		return nil, err
+	}
+	r := &reservation{owner: callerIdentity(ctx), size: size}
+	s.reserved[id] = r
+	return r, nil
+}
+
+// release gives the room of the reservation id back.
+func (s *grpcServer) release(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.reserved, id)
+}
+
+// usage is what the caller of ctx stores and has open. Without a token
+// file everyone shares the whole store. The caller holds s.mu.
+func (s *grpcServer) usage(ctx context.Context) int64 {
+	var used int64
+	if us, ok := s.storage.(*usageStorage); ok {
+		used = us.used(s.userPrefix(ctx))
+	}
+	u := userFrom(ctx)
+	for _, up := range s.uploads {
+		if u == nil || up.owner == u.name {
+			used += up.size
+		}
+	}
+	for _, r := range s.reserved {
+		if u == nil || r.owner == u.name {
+			used += r.size
+		}
+	}
+	return used
+}
+
+// pendingBytes is what the open uploads and reservations have yet to
+// write.
+func (s *grpcServer) pendingBytes() int64 {
+	var pending int64
+	for _, up := range s.uploads {
+		up.mu.Lock()
+		pending += up.size - up.received.total()
+		up.mu.Unlock()
+	}
+	for _, r := range s.reserved {
+		pending += r.size - atomic.LoadInt64(&r.written)
+	}
+	return pending
+}
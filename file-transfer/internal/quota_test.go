@@ -0,0 +1,140 @@
+package internal
+
+import (
+	"context"
+	"testing"
+	"time"
+	"wangweizZZ/go-daily-study/file-transfer/internal/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestUsageStorageCounts(t *testing.T) {
+	inner := NewMemoryStorage()
+	stage(t, inner, "old", make([]byte, 100))
+	if err := inner.Commit("old", "alice/existing", 100); err != nil {
+		t.Fatal(err)
+	}
+	us, err := newUsageStorage(inner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(step string, alice, bob, total int64) {
+		t.Helper()
+		if got := us.used("alice/"); got != alice {
+			t.Errorf("%s: alice uses %d, want %d", step, got, alice)
+		}
+		if got := us.used("bob/"); got != bob {
+			t.Errorf("%s: bob uses %d, want %d", step, got, bob)
+		}
+		if got := us.used(""); got != total {
+			t.Errorf("%s: store holds %d, want %d", step, got, total)
+		}
+	}
+	check("loaded", 100, 0, 100)
+
+	stage(t, us, "a", make([]byte, 50))
+	if err = us.Commit("a", "alice/a", 50); err != nil {
+		t.Fatal(err)
+	}
+	check("commit", 150, 0, 150)
+
+	stage(t, us, "b", make([]byte, 30))
+	if err = us.Commit("b", "alice/a", 30); err != nil {
+		t.Fatal(err)
+	}
+	check("replace", 130, 0, 130)
+
+	stage(t, us, "c", make([]byte, 7))
+	if err = us.Commit("c", "top-level", 7); err != nil {
+		t.Fatal(err)
+	}
+	check("commit outside user directories", 130, 0, 137)
+
+	if err = us.Rename("alice/a", "bob/a"); err != nil {
+		t.Fatal(err)
+	}
+	check("rename", 100, 30, 137)
+
+	if err = us.Delete("alice/existing"); err != nil {
+		t.Fatal(err)
+	}
+	check("delete", 0, 30, 37)
+
+	//failed changes count nothing
+	if err = us.Delete("alice/existing"); err == nil {
+		t.Fatal("deleted a missing file")
+	}
+	if err = us.Rename("bob/a", "top-level"); err == nil {
+		t.Fatal("renamed onto a taken key")
+	}
+	if err = us.Commit("never staged", "bob/b", 10); err == nil {
+		t.Fatal("committed an unknown upload")
+	}
+	check("failures", 0, 30, 37)
+}
+
+func TestPatchReservesQuota(t *testing.T) {
+	ts := startTestServer(t, WithServerQuota(0, 1000))
+	c := ts.client(t)
+	if err := c.Transfer(writeLocal(t, "a.bin", randomBytes(9, 400))); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sigs, err := c.innerClient.Signatures(ctx, &proto.SignatureRequest{Name: "a.bin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch, err := sigs.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	patch, err := c.innerClient.Patch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = patch.Send(&proto.DeltaOp{Op: &proto.DeltaOp_Header{Header: &proto.DeltaHeader{
+		Name:        "a.bin",
+		Size:        500,
+		DigestType:  proto.DigestType_Sha256,
+		BlockSize:   batch.GetBlockSize(),
+		BaseSize:    batch.GetSize(),
+		BaseModTime: batch.GetModTime(),
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reserved := func() int {
+		ts.mu.Lock()
+		defer ts.mu.Unlock()
+		return len(ts.reserved)
+	}
+	waitFor(t, "the patch to be admitted", func() bool { return reserved() == 1 })
+
+	//like an open upload the patch holds its whole size until it commits,
+	//next to the 400 bytes of a.bin
+	if _, err = c.doOpen(context.Background(), "b.bin", 101, true); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("open over the quota left by the patch: %v", err)
+	}
+	if _, err = c.doOpen(context.Background(), "b.bin", 100, true); err != nil {
+		t.Fatalf("open within the quota left by the patch: %v", err)
+	}
+
+	cancel()
+	waitFor(t, "the patch to be released", func() bool { return reserved() == 0 })
+	if _, err = c.doOpen(context.Background(), "c.bin", 500, true); err != nil {
+		t.Fatalf("open after the patch ended: %v", err)
+	}
+}
+
+// waitFor polls cond until it holds, failing the test after a while.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package internal
+
+import "sort"
+
+// byteRange is the half-open interval [Start, End) of a file.
+type byteRange struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
+
+// rangeSet is a sorted list of non-overlapping byte ranges.
+type rangeSet []byteRange
+
+// add marks [start, end) as present, merging it with neighbours.
+func (rs rangeSet) add(start, end int64) rangeSet {
+	if start >= end {
+		return rs
+	}
+	rs = append(rs, byteRange{Start: start, End: end})
+	sort.Slice(rs, func(i, j int) bool { return rs[i].Start < rs[j].Start })
+
+	merged := rs[:1]
+	for _, r := range rs[1:] {
+		last := &merged[len(merged)-1]
+		if r.Start <= last.End {
+			if r.End > last.End {
+				last.End = r.End
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// contiguous returns the end of the range starting at zero.
+func (rs rangeSet) contiguous() int64 {
+	if len(rs) == 0 || rs[0].Start != 0 {
+		return 0
+	}
+	return rs[0].End
+}
+
+// total counts the bytes present.
+func (rs rangeSet) total() int64 {
+	var n int64
+	for _, r := range rs {
+		n += r.End - r.Start
+	}
+	return n
+}
+
+// covers reports whether every byte in [0, size) is present.
+func (rs rangeSet) covers(size int64) bool {
+	return rs.contiguous() >= size
+}
+
+// splitRange cuts [start, end) into at most n ranges of similar size,
+// it always returns at least one range so an empty tail still gets a stream.
+func splitRange(start, end int64, n int) []byteRange {
+	if n < 1 {
+		n = 1
+	}
+	total := end - start
+	if total < int64(n) {
+		n = 1
+	}
+	part := total / int64(n)
+	ranges := make([]byteRange, 0, n)
+	for i := 0; i < n; i++ {
+		r := byteRange{Start: start + int64(i)*part, End: start + int64(i+1)*part}
+		if i == n-1 {
+			r.End = end
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges
+}
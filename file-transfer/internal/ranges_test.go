@@ -0,0 +1,98 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRangeSetAdd(t *testing.T) {
+	tests := []struct {
+		name   string
+		adds   []byteRange
+		want   rangeSet
+		total  int64
+		prefix int64
+	}{
+		{"empty", nil, nil, 0, 0},
+		{"single", []byteRange{{0, 10}}, rangeSet{{0, 10}}, 10, 10},
+		{"empty range", []byteRange{{5, 5}, {7, 3}}, nil, 0, 0},
+		{"adjacent", []byteRange{{0, 10}, {10, 20}}, rangeSet{{0, 20}}, 20, 20},
+		{"overlapping", []byteRange{{0, 10}, {5, 15}}, rangeSet{{0, 15}}, 15, 15},
+		{"contained", []byteRange{{0, 20}, {5, 10}}, rangeSet{{0, 20}}, 20, 20},
+		{"duplicate", []byteRange{{0, 10}, {0, 10}}, rangeSet{{0, 10}}, 10, 10},
+		{"gap", []byteRange{{0, 10}, {20, 30}}, rangeSet{{0, 10}, {20, 30}}, 20, 10},
+		{"not from zero", []byteRange{{10, 20}}, rangeSet{{10, 20}}, 10, 0},
+		{"out of order", []byteRange{{20, 30}, {10, 20}, {0, 10}}, rangeSet{{0, 30}}, 30, 30},
+		{"out of order with gap", []byteRange{{30, 40}, {0, 10}, {15, 20}}, rangeSet{{0, 10}, {15, 20}, {30, 40}}, 25, 10},
+		{"bridging", []byteRange{{0, 10}, {20, 30}, {5, 25}}, rangeSet{{0, 30}}, 30, 30},
+		{"spanning many", []byteRange{{2, 3}, {5, 6}, {8, 9}, {0, 10}}, rangeSet{{0, 10}}, 10, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var rs rangeSet
+			for _, r := range tt.adds {
+				rs = rs.add(r.Start, r.End)
+			}
+			if len(rs) == 0 && len(tt.want) == 0 {
+				rs = nil
+			}
+			if !reflect.DeepEqual(rs, tt.want) {
+				t.Fatalf("got %v, want %v", rs, tt.want)
+			}
+			if got := rs.total(); got != tt.total {
+				t.Errorf("total %d, want %d", got, tt.total)
+			}
+			if got := rs.contiguous(); got != tt.prefix {
+				t.Errorf("contiguous %d, want %d", got, tt.prefix)
+			}
+		})
+	}
+}
+
+func TestRangeSetCovers(t *testing.T) {
+	tests := []struct {
+		name string
+		rs   rangeSet
+		size int64
+		want bool
+	}{
+		{"empty file", nil, 0, true},
+		{"nothing", nil, 10, false},
+		{"all", rangeSet{{0, 10}}, 10, true},
+		{"short", rangeSet{{0, 9}}, 10, false},
+		{"hole", rangeSet{{0, 4}, {5, 10}}, 10, false},
+		{"missing head", rangeSet{{1, 10}}, 10, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rs.covers(tt.size); got != tt.want {
+				t.Errorf("covers(%d) of %v = %v, want %v", tt.size, tt.rs, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitRange(t *testing.T) {
+	tests := []struct {
+		name       string
+		start, end int64
+		n          int
+		want       []byteRange
+	}{
+		{"one stream", 0, 10, 1, []byteRange{{0, 10}}},
+		{"even", 0, 10, 2, []byteRange{{0, 5}, {5, 10}}},
+		{"remainder in last", 0, 10, 3, []byteRange{{0, 3}, {3, 6}, {6, 10}}},
+		{"from offset", 4, 10, 2, []byteRange{{4, 7}, {7, 10}}},
+		{"fewer bytes than streams", 0, 2, 4, []byteRange{{0, 2}}},
+		{"empty tail", 10, 10, 4, []byteRange{{10, 10}}},
+		{"no streams", 0, 10, 0, []byteRange{{0, 10}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := splitRange(tt.start, tt.end, tt.n)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
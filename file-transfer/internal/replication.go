@@ -0,0 +1,334 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+	"wangweizZZ/go-daily-study/file-transfer/internal/proto"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// the queue lives in the session directory, which no storage lists
+	replication_file string = "replication"
+
+	replica_min_backoff time.Duration = time.Second
+	replica_max_backoff time.Duration = 5 * time.Minute
+)
+
+// replicaItem is a committed file a peer has not acknowledged yet.
+type replicaItem struct {
+	Peer     string    `json:"peer"`
+	Key      string    `json:"key"`
+	Queued   time.Time `json:"queued"`
+	Attempts int       `json:"attempts,omitempty"`
+
+	//a commit while the item is pushed bumps version, so the push of
+	//the older version does not take it off the queue
+	version int
+	updated time.Time
+	next    time.Time
+}
+
+// replicaPeer is a server every committed file is pushed to.
+type replicaPeer struct {
+	addr   string
+	client *grpcClient
+	wake   chan struct{}
+
+	lastPush  time.Time
+	lastError string
+}
+
+// replicator pushes committed files to peer servers with the upload path
+// of the client, one file at a time per peer. The queue is saved on
+// every change so files committed before a crash are still pushed, a
+// push is retried with backoff until the peer acknowledges it.
+type replicator struct {
+	storage Storage
+	path    string
+	log     *Logger
+
+	mu    sync.Mutex
+	queue []*replicaItem
+	peers []*replicaPeer
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// startReplication loads the queue saved in dir and starts pushing to
+// peers.
+func startReplication(storage Storage, dir string, log *Logger, peers []string, opts []ClientOption) (*replicator, error) {
+	r := &replicator{storage: storage, path: filepath.Join(dir, replication_file), log: log}
+	known := make(map[string]bool)
+	for _, addr := range peers {
+		if known[addr] {
+			return nil, errors.Errorf("replication peer %s is listed twice", addr)
+		}
+		known[addr] = true
+		peerOpts := append(append([]ClientOption(nil), opts...), WithClientLogger(log.With("replica", addr)))
+		r.peers = append(r.peers, &replicaPeer{
+			addr:   addr,
+			client: NewGrpcClient(addr, NewClientConfig(peerOpts...)),
+			wake:   make(chan struct{}, 1),
+		})
+	}
+
+	data, err := ioutil.ReadFile(r.path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		var items []*replicaItem
+		if err = json.Unmarshal(data, &items); err != nil {
+			return nil, errors.Wrap(err, "failed to load the replication queue")
+		}
+		for _, item := range items {
+			if !known[item.Peer] {
+				log.Warn("dropped replication of a peer no longer configured", "replica", item.Peer, "file", item.Key)
+				continue
+			}
+			item.updated = item.Queued
+			r.queue = append(r.queue, item)
+		}
+		log.Info("loaded replication queue", "queued", len(r.queue))
+	}
+
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+	for _, p := range r.peers {
+		r.wg.Add(1)
+		go r.run(p)
+	}
+	return r, nil
+}
+
+// close stops pushing, files that were being pushed stay queued.
+func (r *replicator) close() {
+	r.cancel()
+	r.wg.Wait()
+	for _, p := range r.peers {
+		p.client.Close()
+	}
+}
+
+// enqueue queues the file at key for every peer.
+func (r *replicator) enqueue(key string) error {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, p := range r.peers {
+		var item *replicaItem
+		for _, queued := range r.queue {
+			if queued.Peer == p.addr && queued.Key == key {
+				item = queued
+				break
+			}
+		}
+		if item == nil {
+			item = &replicaItem{Peer: p.addr, Key: key, Queued: now}
+			r.queue = append(r.queue, item)
+		}
+		//a new version is pushed right away
+		item.version++
+		item.updated = now
+		item.Attempts, item.next = 0, time.Time{}
+	}
+	for _, p := range r.peers {
+		select {
+		case p.wake <- struct{}{}:
+		default:
+		}
+	}
+	return r.save()
+}
+
+// run pushes the queue of p until the replicator closes.
+func (r *replicator) run(p *replicaPeer) {
+	defer r.wg.Done()
+	for r.ctx.Err() == nil {
+		item, version, wait := r.next(p)
+		if item != nil {
+			r.push(p, item, version)
+			continue
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-r.ctx.Done():
+			timer.Stop()
+			return
+		case <-p.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// next is the oldest item of p that is due, or how long until one is.
+func (r *replicator) next(p *replicaPeer) (*replicaItem, int, time.Duration) {
+	now := time.Now()
+	wait := time.Hour
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, item := range r.queue {
+		if item.Peer != p.addr {
+			continue
+		}
+		if !now.Before(item.next) {
+			return item, item.version, 0
+		}
+		if d := item.next.Sub(now); d < wait {
+			wait = d
+		}
+	}
+	return nil, 0, wait
+}
+
+// push sends the current version of the file of item to p.
+func (r *replicator) push(p *replicaPeer, item *replicaItem, version int) {
+	log := r.log.With("replica", p.addr, "file", item.Key)
+	stored, err := r.storage.Open(item.Key)
+	if os.IsNotExist(err) {
+		log.Warn("replication skipped, the file is gone")
+		r.done(p, item, version, nil)
+		return
+	}
+	if err != nil {
+		r.done(p, item, version, err)
+		log.Warn("replication failed", "error", err)
+		return
+	}
+	defer stored.Close()
+
+	ctx, cancel := context.WithTimeout(r.ctx, p.client.config.retry.Deadline)
+	defer cancel()
+	started := time.Now()
+	err = p.client.transferReader(ctx, stored, item.Key, stored.Info().Size)
+	if r.ctx.Err() != nil {
+		//stopped, pushed again after a restart
+		return
+	}
+	attempts := r.done(p, item, version, err)
+	if err != nil {
+		log.Warn("replication failed, trying again later", "attempts", attempts, "error", err)
+		return
+	}
+	log.Info("file replicated", "size", stored.Info().Size, "duration", time.Since(started))
+}
+
+// done takes an acknowledged item off the queue, a failed one waits
+// longer after every attempt. It returns the attempts so far.
+func (r *replicator) done(p *replicaPeer, item *replicaItem, version int, err error) int {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		p.lastError = err.Error()
+		item.Attempts++
+		backoff := replica_min_backoff << uint(item.Attempts-1)
+		if backoff > replica_max_backoff || backoff <= 0 {
+			backoff = replica_max_backoff
+		}
+		item.next = now.Add(backoff)
+	} else {
+		p.lastPush, p.lastError = now, ""
+		if item.version == version {
+			for i, queued := range r.queue {
+				if queued == item {
+					r.queue = append(r.queue[:i], r.queue[i+1:]...)
+					break
+				}
+			}
+		} else {
+			//the peer has an older version, it is behind since the new one
+			item.Queued = item.updated
+		}
+	}
+	if err := r.save(); err != nil {
+		r.log.Error("save replication queue failed", "error", err)
+	}
+	return item.Attempts
+}
+
+// save writes the queue, the caller holds r.mu.
+func (r *replicator) save() error {
+	data, err := json.Marshal(r.queue)
+	if err != nil {
+		return err
+	}
+	//write aside and rename, like the sessions
+	if err = ioutil.WriteFile(r.path+tmp_file_suffix, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(r.path+tmp_file_suffix, r.path)
+}
+
+// status reports the queue and the lag of every peer, in the order the
+// peers were given.
+func (r *replicator) status() []*proto.PeerReplication {
+	now := time.Now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	peers := make([]*proto.PeerReplication, 0, len(r.peers))
+	for _, p := range r.peers {
+		status := &proto.PeerReplication{Peer: p.addr, LastError: p.lastError}
+		if !p.lastPush.IsZero() {
+			status.LastPush = p.lastPush.Unix()
+		}
+		var oldest time.Time
+		for _, item := range r.queue {
+			if item.Peer != p.addr {
+				continue
+			}
+			status.Queued++
+			if oldest.IsZero() || item.Queued.Before(oldest) {
+				oldest = item.Queued
+			}
+		}
+		if !oldest.IsZero() {
+			status.LagMs = now.Sub(oldest).Milliseconds()
+		}
+		peers = append(peers, status)
+	}
+	return peers
+}
+
+var (
+	replication_queued_desc = prometheus.NewDesc("file_transfer_replication_queued_files",
+		"Committed files a replication peer has not acknowledged yet.", []string{"peer"}, nil)
+	replication_lag_desc = prometheus.NewDesc("file_transfer_replication_lag_seconds",
+		"Age of the oldest file a replication peer has not acknowledged, 0 when it has everything.", []string{"peer"}, nil)
+)
+
+// replicationCollector reports the queue and the lag of every peer when
+// scraped.
+type replicationCollector struct {
+	r *replicator
+}
+
+func (c replicationCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- replication_queued_desc
+	ch <- replication_lag_desc
+}
+
+func (c replicationCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, p := range c.r.status() {
+		ch <- prometheus.MustNewConstMetric(replication_queued_desc, prometheus.GaugeValue, float64(p.Queued), p.Peer)
+		ch <- prometheus.MustNewConstMetric(replication_lag_desc, prometheus.GaugeValue, float64(p.LagMs)/1000, p.Peer)
+	}
+}
+
+// replicaPush reports whether ctx is a call of a replication peer, which
+// only a replica user of the token file can be. Files committed by them
+// are not replicated again so two servers can replicate to each other.
+func replicaPush(ctx context.Context) bool {
+	u := userFrom(ctx)
+	return u != nil && u.replica
+}
@@ -0,0 +1,134 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestReplicaPushNeedsReplicaUser(t *testing.T) {
+	//the header older replicas send must not skip the quota
+	header := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-file-transfer-replica", "1"))
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want bool
+	}{
+		{"anonymous", context.Background(), false},
+		{"anonymous with header", header, false},
+		{"user with header", context.WithValue(header, userKey{}, &user{name: "alice"}), false},
+		{"admin with header", context.WithValue(header, userKey{}, &user{name: "root", admin: true}), false},
+		{"replica", context.WithValue(context.Background(), userKey{}, &user{name: "peer", replica: true}), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := replicaPush(tt.ctx); got != tt.want {
+				t.Errorf("replicaPush = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplicaMethods(t *testing.T) {
+	a, err := loadTokens(writeTokens(t, test_tokens+"peer peer-token replica\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	methods := []string{"Open", "Write", "Patch", "Signatures", "Read", "List", "Stat", "Delete", "Rename",
+		"Manifest", "Share", "RevokeShare", "Replication", "SetRateLimit", "WatchTransfers"}
+	for _, name := range methods {
+		method := "/TransferService/" + name
+		t.Run(name, func(t *testing.T) {
+			ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(auth_header, "Bearer peer-token"))
+			_, err := a.authenticate(ctx, method)
+			want := codes.PermissionDenied
+			if replicaMethods[method] {
+				want = codes.OK
+			}
+			if status.Code(err) != want {
+				t.Errorf("got %v, want %s", err, want)
+			}
+		})
+	}
+
+	ts := startTestServer(t, WithServerTokens(writeTokens(t, test_tokens+"peer peer-token replica\n")))
+	for _, method := range []string{http.MethodGet, http.MethodPut} {
+		req, err := http.NewRequest(method, "http://"+ts.httpAddr+files_path+"alice/a.txt", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(auth_header, bearer_prefix+"peer-token")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusForbidden {
+			t.Errorf("%s by a replica status %d, want %d", method, res.StatusCode, http.StatusForbidden)
+		}
+	}
+}
+
+func TestReplicationNeedsTokens(t *testing.T) {
+	s := NewGrpcServer(freeAddr(t), NewServerConfig(WithServerStore(t.TempDir()), WithServerLogger(quietLogger),
+		WithServerReplication([]string{freeAddr(t)})))
+	if err := s.Start(); err == nil {
+		s.stop()
+		t.Fatal("replication started without a token file")
+	}
+}
+
+// queued counts the files r has not pushed yet.
+func queued(r *replicator) int {
+	var n int
+	for _, p := range r.status() {
+		n += int(p.GetQueued())
+	}
+	return n
+}
+
+func TestMutualReplication(t *testing.T) {
+	addrA, addrB := freeAddr(t), freeAddr(t)
+	a := startTestServerAt(t, addrA,
+		WithServerTokens(writeTokens(t, "alice alice-token rw\nb b-token replica\n")),
+		WithServerReplication([]string{addrB}, WithToken("a-token")))
+	b := startTestServerAt(t, addrB,
+		WithServerTokens(writeTokens(t, "alice alice-token rw\na a-token replica\n")),
+		WithServerReplication([]string{addrA}, WithToken("b-token")))
+
+	data := randomBytes(5, 2*chunk_size)
+	if err := a.client(t, WithToken("alice-token")).Transfer(writeLocal(t, "x.bin", data)); err != nil {
+		t.Fatal(err)
+	}
+	aliceOnB := b.client(t, WithToken("alice-token"))
+	waitFor(t, "the push to b", func() bool {
+		stat, err := aliceOnB.Stat("x.bin")
+		return err == nil && stat.GetSize() == int64(len(data))
+	})
+	//a takes the file off its queue once b committed it, so b queued
+	//whatever it would send back by then
+	waitFor(t, "the acknowledgement of b", func() bool { return queued(a.replicas) == 0 })
+	if n := queued(b.replicas); n != 0 {
+		t.Errorf("b queued %d files to send back", n)
+	}
+	for name, ts := range map[string]*testServer{"a": a, "b": b} {
+		if n := testutil.ToFloat64(ts.metrics.committedFiles); n != 1 {
+			t.Errorf("%s committed %v files, want 1", name, n)
+		}
+	}
+
+	//replication is one way per upload, a file of b goes to a as well
+	if err := aliceOnB.Transfer(writeLocal(t, "y.bin", data[:100])); err != nil {
+		t.Fatal(err)
+	}
+	aliceOnA := a.client(t, WithToken("alice-token"))
+	waitFor(t, "the push to a", func() bool {
+		_, err := aliceOnA.Stat("y.bin")
+		return err == nil
+	})
+}
@@ -0,0 +1,79 @@
+package internal
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// cleanName normalizes a slash separated name sent by a client and
+// rejects anything that could end up outside of the store or collide
+// with the files the server keeps for itself.
+func cleanName(name string) (string, error) {
+	switch {
+	case name == "":
+		return "", errors.New("empty name")
+	case strings.ContainsAny(name, "\x00\\"):
+		return "", errors.Errorf("invalid character in name %q", name)
+	case path.IsAbs(name) || filepath.IsAbs(name) || filepath.VolumeName(filepath.FromSlash(name)) != "":
+		return "", errors.Errorf("absolute name %q", name)
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if elem == ".." {
+			return "", errors.Errorf("name %q leaves the store", name)
+		}
+	}
+
+	clean := path.Clean(name)
+	switch {
+	case clean == ".":
+		return "", errors.Errorf("name %q is the store itself", name)
+	case strings.SplitN(clean, "/", 2)[0] == session_dir:
+		return "", errors.Errorf("name %q is reserved", name)
+	case strings.HasSuffix(clean, tmp_file_suffix):
+		return "", errors.Errorf("suffix %s is reserved", tmp_file_suffix)
+	}
+	return clean, nil
+}
+
+// resolvePath joins a clean name below root and follows the symlinks of
+// the part that already exists, none of them may lead out of root.
+func resolvePath(root string, name string) (string, error) {
+	root = filepath.Clean(root)
+	full := filepath.Join(root, filepath.FromSlash(name))
+
+	realRoot, err := filepath.EvalSymlinks(root)
+	if os.IsNotExist(err) {
+		//nothing below a missing root can be a link
+		return full, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	for existing := full; existing != root; existing = filepath.Dir(existing) {
+		real, err := filepath.EvalSymlinks(existing)
+		if err == nil {
+			if !within(realRoot, real) {
+				return "", errors.Errorf("name %q links out of the store", name)
+			}
+			return full, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", err
+		}
+		if _, err = os.Lstat(existing); err == nil {
+			return "", errors.Errorf("name %q is a dangling link", name)
+		}
+	}
+	return full, nil
+}
+
+// within reports whether p is root or below it.
+func within(root string, p string) bool {
+	rel, err := filepath.Rel(root, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
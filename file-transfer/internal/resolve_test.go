@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCleanName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+		ok   bool
+	}{
+		{"a.txt", "a.txt", true},
+		{"dir/a.txt", "dir/a.txt", true},
+		{"./dir//a.txt", "dir/a.txt", true},
+		{"dir/./a.txt", "dir/a.txt", true},
+		{"..a/b..", "..a/b..", true},
+		{".sessionsx/a", ".sessionsx/a", true},
+		{"a.tmp/b", "a.tmp/b", true},
+
+		{"", "", false},
+		{".", "", false},
+		{"./", "", false},
+		{"..", "", false},
+		{"../a", "", false},
+		{"a/../b", "", false},
+		{"a/../../b", "", false},
+		{"a/..", "", false},
+		{"/etc/passwd", "", false},
+		{"//a", "", false},
+		{`a\..\b`, "", false},
+		{"a\x00b", "", false},
+		{".sessions", "", false},
+		{".sessions/abc.json", "", false},
+		{"./.sessions/abc", "", false},
+		{"a.tmp", "", false},
+		{"dir/a.tmp", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := cleanName(tt.name)
+			if (err == nil) != tt.ok {
+				t.Fatalf("cleanName(%q) = %q, %v", tt.name, got, err)
+			}
+			if got != tt.want {
+				t.Errorf("cleanName(%q) = %q, want %q", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolvePath(t *testing.T) {
+	base, err := ioutil.TempDir("", "resolve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+	root := filepath.Join(base, "store")
+	outside := filepath.Join(base, "outside")
+	for _, dir := range []string{filepath.Join(root, "dir"), outside} {
+		if err = os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	links := map[string]string{
+		"inside":   filepath.Join(root, "dir"),
+		"relative": "dir",
+		"escape":   outside,
+		"up":       "..",
+		"dangling": filepath.Join(root, "missing"),
+		"dir/back": "../../outside",
+	}
+	for name, target := range links {
+		if err = os.Symlink(target, filepath.Join(root, filepath.FromSlash(name))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"a.txt", true},
+		{"dir/a.txt", true},
+		{"new/deeper/a.txt", true},
+		{"inside/a.txt", true},
+		{"relative/a.txt", true},
+		{"escape", false},
+		{"escape/a.txt", false},
+		{"escape/new/a.txt", false},
+		{"up/a.txt", false},
+		{"dir/back/a.txt", false},
+		{"dangling", false},
+		{"dangling/a.txt", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolvePath(root, tt.name)
+			if (err == nil) != tt.ok {
+				t.Fatalf("resolvePath(%q) = %q, %v", tt.name, got, err)
+			}
+			if want := filepath.Join(root, filepath.FromSlash(tt.name)); tt.ok && got != want {
+				t.Errorf("resolvePath(%q) = %q, want %q", tt.name, got, want)
+			}
+		})
+	}
+}
+
+func TestResolvePathMissingRoot(t *testing.T) {
+	root := filepath.Join(os.TempDir(), "resolve-missing-root")
+	got, err := resolvePath(root, "a/b.txt")
+	if err != nil || got != filepath.Join(root, "a", "b.txt") {
+		t.Fatalf("got %q, %v", got, err)
+	}
+}
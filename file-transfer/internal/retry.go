@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"context"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// dial_timeout bounds connecting to the server, and waiting for a lost
+// connection to come back before an attempt counts as failed.
+const dial_timeout time.Duration = 10 * time.Second
+
+// RetryPolicy decides how often and how long an upload is retried after
+// a transient failure. Every retry opens the upload again to learn what
+// the server already has and resumes from there.
+type RetryPolicy struct {
+	// MaxAttempts counts the first try, 1 turns retries off.
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Deadline bounds an upload including all of its retries.
+	Deadline time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    5,
+	InitialBackoff: 500 * time.Millisecond,
+	MaxBackoff:     30 * time.Second,
+	Deadline:       10 * time.Minute,
+}
+
+// errIncomplete is returned when the server ends an upload without the
+// whole file, what is missing is sent again on the next attempt.
+var errIncomplete = errors.New("server is still missing parts of the file")
+
+// errChanged is returned when the file on the server no longer matches a
+// partial download, the next attempt starts over from the first byte.
+var errChanged = errors.New("file changed on the server since the partial download")
+
+// transient reports whether err may go away when the call is repeated.
+// Everything else, such as a rejected name, a failed digest or a quota,
+// fails the upload right away.
+func transient(err error) bool {
+	if err == errIncomplete || err == errChanged {
+		return true
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.Aborted, codes.DeadlineExceeded:
+		return true
+	case codes.Unknown:
+		//grpc reports a connection cut after a server started draining this way
+		return strings.Contains(status.Convert(err).Message(), "closing transport")
+	default:
+		return false
+	}
+}
+
+// retry runs attempt until it succeeds, fails for good, runs out of
+// attempts or ctx ends, backing off exponentially with jitter.
+func (c *grpcClient) retry(ctx context.Context, log *Logger, attempt func() error) error {
+	policy := c.config.retry
+	backoff := policy.InitialBackoff
+	for i := 1; ; i++ {
+		err := attempt()
+		if err == nil || !transient(err) || i >= policy.MaxAttempts || ctx.Err() != nil {
+			return err
+		}
+
+		//half fixed, half random, so clients cut off together do not come back together
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		log.Warn("attempt failed, retrying", "attempt", i, "max_attempts", policy.MaxAttempts, "wait", wait.Round(time.Millisecond), "error", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		if backoff *= 2; backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+		c.reconnect()
+	}
+}
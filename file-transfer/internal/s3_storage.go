@@ -0,0 +1,465 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	min_part_size     int64 = 5 << 20
+	default_part_size int64 = 16 << 20
+	// reads of stored objects fetch at least this much at once
+	s3_read_ahead int64 = 1 << 20
+)
+
+var _ Storage = &s3Storage{}
+
+// S3Config points at a bucket of an S3 compatible service. Objects are
+// addressed path style, so local stand-ins work without dns tricks.
+type S3Config struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	// PartSize is the part size of multipart uploads, smaller files are
+	// sent with a single put.
+	PartSize int64
+}
+
+// s3Storage stages uploads on local disk, since chunks arrive in any
+// order, and sends them to the bucket on commit.
+type s3Storage struct {
+	conf    S3Config
+	base    *url.URL
+	client  *http.Client
+	staging *localStorage
+}
+
+// NewS3Storage keeps files in a bucket and stages uploads below spool.
+func NewS3Storage(conf S3Config, spool string) (Storage, error) {
+	if conf.Bucket == "" {
+		return nil, errors.New("s3 bucket is required")
+	}
+	base, err := url.Parse(conf.Endpoint)
+	if err != nil || base.Host == "" || (base.Scheme != "http" && base.Scheme != "https") {
+		return nil, errors.Errorf("invalid s3 endpoint %q", conf.Endpoint)
+	}
+	if conf.Region == "" {
+		conf.Region = "us-east-1"
+	}
+	if conf.PartSize == 0 {
+		conf.PartSize = default_part_size
+	}
+	if conf.PartSize < min_part_size {
+		return nil, errors.Errorf("s3 part size must be at least %d", min_part_size)
+	}
+	return &s3Storage{
+		conf:    conf,
+		base:    base,
+		client:  &http.Client{},
+		staging: &localStorage{root: spool},
+	}, nil
+}
+
+// FreeSpace is the room left for staging, the bucket is taken as
+// unlimited.
+func (s *s3Storage) FreeSpace() (int64, error) {
+	//local storages only report free space where the platform tells
+	if reporter, ok := interface{}(s.staging).(spaceReporter); ok {
+		return reporter.FreeSpace()
+	}
+	return math.MaxInt64, nil
+}
+
+func (s *s3Storage) Create(id string) (StagedFile, error) {
+	return s.staging.Create(id)
+}
+
+func (s *s3Storage) OpenStaged(id string) (StagedFile, error) {
+	return s.staging.OpenStaged(id)
+}
+
+func (s *s3Storage) Abort(id string) error {
+	return s.staging.Abort(id)
+}
+
+func (s *s3Storage) Commit(id string, key string, size int64) error {
+	staged, err := os.Open(s.staging.stagedPath(id))
+	if err != nil {
+		return err
+	}
+	defer staged.Close()
+	if size <= s.conf.PartSize {
+		body := make([]byte, size)
+		if _, err = io.ReadFull(io.NewSectionReader(staged, 0, size), body); err != nil {
+			return err
+		}
+		_, err = s.do("PUT", key, nil, nil, body)
+	} else {
+		err = s.multipartUpload(key, staged, size)
+	}
+	if err != nil {
+		return err
+	}
+	return s.staging.Abort(id)
+}
+
+type s3Part struct {
+	PartNumber int
+	ETag       string
+}
+
+// multipartUpload sends the first size bytes of r in parts, a failed
+// upload is aborted so the bucket does not keep the parts around.
+func (s *s3Storage) multipartUpload(key string, r io.ReaderAt, size int64) error {
+	resp, err := s.do("POST", key, url.Values{"uploads": {""}}, nil, nil)
+	if err != nil {
+		return err
+	}
+	var initiate struct {
+		UploadId string
+	}
+	if err = xml.Unmarshal(resp.body, &initiate); err != nil {
+		return errors.Wrap(err, "bad s3 multipart response")
+	}
+	uploadId := url.Values{"uploadId": {initiate.UploadId}}
+
+	complete := struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{}
+	buf := make([]byte, s.conf.PartSize)
+	for offset, number := int64(0), 1; offset < size; offset, number = offset+s.conf.PartSize, number+1 {
+		n := s.conf.PartSize
+		if offset+n > size {
+			n = size - offset
+		}
+		if _, err = io.ReadFull(io.NewSectionReader(r, offset, n), buf[:n]); err != nil {
+			break
+		}
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {initiate.UploadId}}
+		if resp, err = s.do("PUT", key, query, nil, buf[:n]); err != nil {
+			break
+		}
+		complete.Parts = append(complete.Parts, s3Part{PartNumber: number, ETag: resp.header.Get("ETag")})
+	}
+	if err == nil {
+		var body []byte
+		if body, err = xml.Marshal(complete); err == nil {
+			_, err = s.do("POST", key, uploadId, nil, body)
+		}
+	}
+	if err != nil {
+		if _, abortErr := s.do("DELETE", key, uploadId, nil, nil); abortErr != nil {
+			return errors.Wrapf(err, "abort of upload %s failed too: %v", initiate.UploadId, abortErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// s3File reads an object through ranged gets. It keeps the last range
+// around, so small sequential reads do not turn into a get each. The
+// gets are pinned to the etag seen on open.
+type s3File struct {
+	s    *s3Storage
+	info FileInfo
+	etag string
+
+	mu     sync.Mutex
+	buf    []byte
+	bufOff int64
+}
+
+func (f *s3File) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	if off >= f.info.Size {
+		return 0, io.EOF
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if off < f.bufOff || off+int64(len(p)) > f.bufOff+int64(len(f.buf)) {
+		n := int64(len(p))
+		if n < s3_read_ahead {
+			n = s3_read_ahead
+		}
+		if off+n > f.info.Size {
+			n = f.info.Size - off
+		}
+		header := http.Header{
+			"Range":    {fmt.Sprintf("bytes=%d-%d", off, off+n-1)},
+			"If-Match": {f.etag},
+		}
+		resp, err := f.s.do("GET", f.info.Name, nil, header, nil)
+		if err != nil {
+			return 0, err
+		}
+		f.buf, f.bufOff = resp.body, off
+	}
+	n := copy(p, f.buf[off-f.bufOff:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *s3File) Close() error {
+	return nil
+}
+
+func (f *s3File) Info() FileInfo {
+	return f.info
+}
+
+func (s *s3Storage) Open(key string) (StoredFile, error) {
+	resp, err := s.do("HEAD", key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	info, err := headInfo(key, resp.header)
+	if err != nil {
+		return nil, err
+	}
+	return &s3File{s: s, info: info, etag: resp.header.Get("ETag")}, nil
+}
+
+func (s *s3Storage) Stat(key string) (FileInfo, error) {
+	resp, err := s.do("HEAD", key, nil, nil, nil)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	return headInfo(key, resp.header)
+}
+
+func headInfo(key string, header http.Header) (FileInfo, error) {
+	size, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return FileInfo{}, errors.Errorf("bad s3 content length for %s", key)
+	}
+	modTime, _ := http.ParseTime(header.Get("Last-Modified"))
+	return FileInfo{Name: key, Size: size, ModTime: modTime}, nil
+}
+
+func (s *s3Storage) List(prefix string) ([]FileInfo, error) {
+	var files []FileInfo
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	for {
+		resp, err := s.do("GET", "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var result struct {
+			Contents []struct {
+				Key          string
+				Size         int64
+				LastModified time.Time
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		if err = xml.Unmarshal(resp.body, &result); err != nil {
+			return nil, errors.Wrap(err, "bad s3 list response")
+		}
+		for _, c := range result.Contents {
+			files = append(files, FileInfo{Name: c.Key, Size: c.Size, ModTime: c.LastModified})
+		}
+		if !result.IsTruncated {
+			return files, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+func (s *s3Storage) Delete(key string) error {
+	if _, err := s.Stat(key); err != nil {
+		return err
+	}
+	_, err := s.do("DELETE", key, nil, nil, nil)
+	return err
+}
+
+// Rename copies and deletes, a single copy only takes objects up to 5GB.
+func (s *s3Storage) Rename(from string, to string) error {
+	if _, err := s.Stat(from); err != nil {
+		return err
+	}
+	if _, err := s.Stat(to); err == nil {
+		return &os.PathError{Op: "rename", Path: to, Err: os.ErrExist}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	source := http.Header{"X-Amz-Copy-Source": {"/" + s.conf.Bucket + "/" + s3Escape(from, true)}}
+	resp, err := s.do("PUT", to, nil, source, nil)
+	if err != nil {
+		return err
+	}
+	//a failed copy can still answer 200 with an error body
+	if bytes.Contains(resp.body, []byte("<Error>")) {
+		return s3Error("PUT", to, resp.body)
+	}
+	_, err = s.do("DELETE", from, nil, nil, nil)
+	return err
+}
+
+type s3Response struct {
+	header http.Header
+	body   []byte
+}
+
+// do sends a signed request for key, or for the bucket when key is
+// empty. Missing keys come back as os.IsNotExist errors.
+func (s *s3Storage) do(method string, key string, query url.Values, header http.Header, body []byte) (*s3Response, error) {
+	u := *s.base
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.conf.Bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = strings.TrimSuffix(s.base.EscapedPath(), "/") + "/" + s3Escape(s.conf.Bucket, false)
+	if key != "" {
+		u.RawPath += "/" + s3Escape(key, true)
+	}
+	u.RawQuery = s3Query(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	s.sign(req, body, time.Now().UTC())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound && key != "":
+		return nil, notExist(strings.ToLower(method), key)
+	case resp.StatusCode == http.StatusPreconditionFailed:
+		return nil, errors.Errorf("s3 object %s changed while it was read", key)
+	case resp.StatusCode/100 != 2:
+		if len(data) == 0 {
+			return nil, errors.Errorf("s3 %s %s: %s", method, key, resp.Status)
+		}
+		return nil, s3Error(method, key, data)
+	}
+	if method == "POST" && bytes.Contains(data, []byte("<Error>")) {
+		return nil, s3Error(method, key, data)
+	}
+	return &s3Response{header: resp.Header, body: data}, nil
+}
+
+func s3Error(method string, key string, body []byte) error {
+	var e struct {
+		Code    string
+		Message string
+	}
+	xml.Unmarshal(body, &e)
+	return errors.Errorf("s3 %s %s: %s %s", method, key, e.Code, e.Message)
+}
+
+// sign adds an AWS signature version 4 to req.
+func (s *s3Storage) sign(req *http.Request, body []byte, now time.Time) {
+	payload := sha256.Sum256(body)
+	amzDate := now.Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payload[:]))
+
+	names := []string{"host"}
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-amz-") {
+			names = append(names, lower)
+		}
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		value := req.URL.Host
+		if name != "host" {
+			value = strings.TrimSpace(req.Header.Get(name))
+		}
+		canonicalHeaders.WriteString(name + ":" + value + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payload[:]),
+	}, "\n")
+	scope := now.Format("20060102") + "/" + s.conf.Region + "/s3/aws4_request"
+	hashed := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashed[:])
+
+	key := []byte("AWS4" + s.conf.SecretKey)
+	for _, part := range []string{now.Format("20060102"), s.conf.Region, "s3", "aws4_request", toSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.conf.AccessKey, scope, signedHeaders, hex.EncodeToString(key)))
+}
+
+// s3Query encodes query the way it is signed, sorted and with every
+// reserved character escaped.
+func s3Query(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k, false)+"="+s3Escape(v, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape percent encodes everything but the unreserved characters,
+// and slashes when keepSlash is set.
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && keepSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
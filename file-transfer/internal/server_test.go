@@ -0,0 +1,99 @@
+package internal
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testServer is a server on free local ports with the http gateway on.
+type testServer struct {
+	*grpcServer
+	addr     string
+	httpAddr string
+	store    string
+}
+
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lis.Close()
+	return lis.Addr().String()
+}
+
+var quietLogger = NewLogger(ioutil.Discard, false, LevelError)
+
+// startTestServer starts a server on a store of its own, stopped when
+// the test ends.
+func startTestServer(t *testing.T, opts ...ServerOption) *testServer {
+	t.Helper()
+	return startTestServerAt(t, freeAddr(t), opts...)
+}
+
+// startTestServerAt is startTestServer listening on addr, for servers
+// that must know each other's address before they start.
+func startTestServerAt(t *testing.T, addr string, opts ...ServerOption) *testServer {
+	t.Helper()
+	ts := &testServer{addr: addr, httpAddr: freeAddr(t), store: t.TempDir()}
+	opts = append([]ServerOption{WithServerStore(ts.store), WithServerHTTP(ts.httpAddr), WithServerLogger(quietLogger)}, opts...)
+	ts.grpcServer = NewGrpcServer(ts.addr, NewServerConfig(opts...))
+	started := make(chan error, 1)
+	go func() { started <- ts.Start() }()
+	for _, addr := range []string{ts.addr, ts.httpAddr} {
+		for deadline := time.Now().Add(5 * time.Second); ; {
+			conn, err := net.Dial("tcp", addr)
+			if err == nil {
+				conn.Close()
+				break
+			}
+			select {
+			case err := <-started:
+				t.Fatalf("server did not start: %v", err)
+			default:
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("server is not listening on %s", addr)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	t.Cleanup(ts.stop)
+	return ts
+}
+
+// client connects to the server, closed when the test ends.
+func (ts *testServer) client(t *testing.T, opts ...ClientOption) *grpcClient {
+	t.Helper()
+	opts = append([]ClientOption{WithClientLogger(quietLogger)}, opts...)
+	c := NewGrpcClient(ts.addr, NewClientConfig(opts...))
+	if err := c.initConn(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	return c
+}
+
+// writeTokens writes a token file of lines for WithServerTokens.
+func writeTokens(t *testing.T, lines string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "tokens")
+	if err := ioutil.WriteFile(path, []byte(lines), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// writeLocal writes data to a file of a temporary directory.
+func writeLocal(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
@@ -0,0 +1,122 @@
+package internal
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"wangweizZZ/go-daily-study/file-transfer/internal/proto"
+)
+
+const (
+	session_dir         string = ".sessions"
+	session_file_suffix string = ".json"
+)
+
+// sessionMeta is the on-disk form of an upload, it is kept next to the
+// data so a restarted server can hand the same session back to clients.
+type sessionMeta struct {
+	Id         string           `json:"id"`
+	Name       string           `json:"name"`
+	Owner      string           `json:"owner"`
+	Size       int64            `json:"size"`
+	DigestType proto.DigestType `json:"digest_type"`
+	Md5        string           `json:"md5,omitempty"`
+	Expected   string           `json:"expected,omitempty"`
+	Received   rangeSet         `json:"received"`
+	Created    time.Time        `json:"created"`
+}
+
+func newSessionId() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// sessionStore keeps the data and metadata of open uploads in dir.
+type sessionStore struct {
+	dir string
+}
+
+func (ss sessionStore) metaPath(id string) string {
+	return filepath.Join(ss.dir, id+session_file_suffix)
+}
+
+// save records the state of u, the upload lock must not be held.
+func (ss sessionStore) save(u *upload) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.result != nil || u.growing {
+		//already committed or rejected, or nothing could resume it
+		return nil
+	}
+	data, err := json.Marshal(sessionMeta{
+		Id:         u.id,
+		Name:       u.name,
+		Owner:      u.owner,
+		Size:       u.size,
+		DigestType: u.digestType,
+		Md5:        u.md5,
+		Expected:   u.expected,
+		Received:   u.received,
+		Created:    u.created,
+	})
+	if err != nil {
+		return err
+	}
+
+	//write aside and rename, so a crash never leaves half a file behind
+	path := ss.metaPath(u.id)
+	if err = ioutil.WriteFile(path+tmp_file_suffix, data, 0666); err != nil {
+		return err
+	}
+	return os.Rename(path+tmp_file_suffix, path)
+}
+
+// remove drops the metadata of a finished session, its data has been
+// committed or aborted by then.
+func (ss sessionStore) remove(id string) error {
+	err := os.Remove(ss.metaPath(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// load reads back every session saved in dir.
+func (ss sessionStore) load() ([]*upload, error) {
+	infos, err := ioutil.ReadDir(ss.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var uploads []*upload
+	for _, info := range infos {
+		if info.IsDir() || !strings.HasSuffix(info.Name(), session_file_suffix) {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(ss.dir, info.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var meta sessionMeta
+		if err = json.Unmarshal(data, &meta); err != nil {
+			return nil, err
+		}
+		up, err := newUpload(meta.Id, meta.Name, meta.Owner, meta.Size, meta.DigestType, meta.Md5)
+		if err != nil {
+			return nil, err
+		}
+		up.expected = meta.Expected
+		up.received = meta.Received
+		up.created = meta.Created
+		uploads = append(uploads, up)
+	}
+	return uploads, nil
+}
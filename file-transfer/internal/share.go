@@ -0,0 +1,228 @@
+package internal
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// both live in the session directory, which no storage lists
+	share_key_file   string = "share.key"
+	share_state_file string = "shares"
+
+	default_share_ttl time.Duration = 24 * time.Hour
+)
+
+// shareState is what the server keeps of an issued link, its token
+// only carries the id signed with the key of the server.
+type shareState struct {
+	Id      string `json:"id"`
+	Key     string `json:"key"`
+	Expires int64  `json:"exp"`
+	Max     int32  `json:"max,omitempty"`
+	Owner   string `json:"owner"`
+	Uses    int32  `json:"uses"`
+	Revoked bool   `json:"revoked,omitempty"`
+}
+
+// shareStore signs share tokens and counts the downloads of every link,
+// the key and the links are kept in dir so links survive a restart.
+type shareStore struct {
+	dir    string
+	secret []byte
+
+	mu    sync.Mutex
+	links map[string]*shareState
+}
+
+// loadShares reads the key and the links saved in dir, a key is made on
+// first use.
+func loadShares(dir string) (*shareStore, error) {
+	ss := &shareStore{dir: dir, links: make(map[string]*shareState)}
+	keyPath := filepath.Join(dir, share_key_file)
+	secret, err := ioutil.ReadFile(keyPath)
+	if os.IsNotExist(err) {
+		secret = make([]byte, 32)
+		if _, err = rand.Read(secret); err != nil {
+			return nil, err
+		}
+		err = ioutil.WriteFile(keyPath, secret, 0600)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load the share key")
+	}
+	ss.secret = secret
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, share_state_file))
+	if os.IsNotExist(err) {
+		return ss, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var links []*shareState
+	if err = json.Unmarshal(data, &links); err != nil {
+		return nil, errors.Wrap(err, "failed to load share links")
+	}
+	for _, link := range links {
+		ss.links[link.Id] = link
+	}
+	return ss, nil
+}
+
+// issue makes a link to the file at key that works for ttl.
+func (ss *shareStore) issue(key string, owner string, ttl time.Duration, max int32) (*shareState, string, error) {
+	id, err := newSessionId()
+	if err != nil {
+		return nil, "", err
+	}
+	link := &shareState{Id: id, Key: key, Expires: time.Now().Add(ttl).Unix(), Max: max, Owner: owner}
+	token := id + "." + base64.RawURLEncoding.EncodeToString(ss.sign(id))
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ss.links[id] = link
+	if err = ss.save(); err != nil {
+		delete(ss.links, id)
+		return nil, "", err
+	}
+	issued := *link
+	return &issued, token, nil
+}
+
+func (ss *shareStore) sign(payload string) []byte {
+	mac := hmac.New(sha256.New, ss.secret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+// verify checks the signature of token and gives the id of its link.
+// Nothing of a token is read before its signature matched.
+func (ss *shareStore) verify(token string) (string, error) {
+	dot := strings.IndexByte(token, '.')
+	if dot < 0 {
+		return "", status.Error(codes.Unauthenticated, "invalid share token")
+	}
+	id := token[:dot]
+	sig := base64.RawURLEncoding.EncodeToString(ss.sign(id))
+	if !hmac.Equal([]byte(token[dot+1:]), []byte(sig)) {
+		return "", status.Error(codes.Unauthenticated, "invalid share token")
+	}
+	return id, nil
+}
+
+// find is the link with id while it works, the caller holds ss.mu.
+func (ss *shareStore) find(id string) (*shareState, error) {
+	link, ok := ss.links[id]
+	switch {
+	case !ok:
+		//save drops the links that expired
+		return nil, status.Error(codes.PermissionDenied, "share link expired or revoked")
+	case link.Revoked:
+		return nil, status.Error(codes.PermissionDenied, "share link revoked")
+	case time.Now().Unix() >= link.Expires:
+		return nil, status.Error(codes.PermissionDenied, "share link expired")
+	case link.Max > 0 && link.Uses >= link.Max:
+		return nil, status.Errorf(codes.PermissionDenied, "share link used up after %d downloads", link.Max)
+	}
+	return link, nil
+}
+
+// peek is the link with id while it works, without using it.
+func (ss *shareStore) peek(id string) (*shareState, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	link, err := ss.find(id)
+	if err != nil {
+		return nil, err
+	}
+	found := *link
+	return &found, nil
+}
+
+// use takes one download of the link with id, so concurrent downloads
+// cannot go over its limit. It is given back with release when nothing
+// of the file went out.
+func (ss *shareStore) use(id string) (*shareState, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	link, err := ss.find(id)
+	if err != nil {
+		return nil, err
+	}
+	link.Uses++
+	if err = ss.save(); err != nil {
+		link.Uses--
+		return nil, err
+	}
+	used := *link
+	return &used, nil
+}
+
+// release gives back a download use took.
+func (ss *shareStore) release(id string) error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	link, ok := ss.links[id]
+	if !ok || link.Uses == 0 {
+		return nil
+	}
+	link.Uses--
+	return ss.save()
+}
+
+// revoke stops the link with the id, or the link of a token, from
+// working before it expires.
+func (ss *shareStore) revoke(id string) (*shareState, error) {
+	if strings.Contains(id, ".") {
+		var err error
+		if id, err = ss.verify(id); err != nil {
+			return nil, err
+		}
+	}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	link, ok := ss.links[id]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "share link %s not found", id)
+	}
+	link.Revoked = true
+	revoked := *link
+	return &revoked, ss.save()
+}
+
+// save writes the links that have not expired, the caller holds ss.mu.
+func (ss *shareStore) save() error {
+	now := time.Now().Unix()
+	links := make([]*shareState, 0, len(ss.links))
+	for id, link := range ss.links {
+		if now >= link.Expires {
+			delete(ss.links, id)
+			continue
+		}
+		links = append(links, link)
+	}
+	data, err := json.Marshal(links)
+	if err != nil {
+		return err
+	}
+	//write aside and rename, like the sessions
+	path := filepath.Join(ss.dir, share_state_file)
+	if err = ioutil.WriteFile(path+tmp_file_suffix, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+tmp_file_suffix, path)
+}
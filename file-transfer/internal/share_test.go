@@ -0,0 +1,266 @@
+package internal
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestShareTokens(t *testing.T) {
+	ss, err := loadShares(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, token, err := ss.issue("alice/c.bin", "alice", time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, err := ss.verify(token); err != nil || id != link.Id {
+		t.Fatalf("verify = %q, %v, want %q", id, err, link.Id)
+	}
+	if strings.Contains(token, "alice") || strings.Contains(token, "c.bin") {
+		t.Errorf("token %q tells the file", token)
+	}
+
+	other, err := loadShares(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, foreign, err := other.issue("alice/c.bin", "alice", time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dot := strings.IndexByte(token, '.')
+	sig := []byte(token[dot+1:])
+	sig[0] ^= 1
+	for name, bad := range map[string]string{
+		"empty":            "",
+		"no signature":     link.Id,
+		"other id":         "x" + token[1:],
+		"other signature":  token[:dot+1] + string(sig),
+		"signature only":   token[dot:],
+		"server of other":  foreign,
+		"claims of before": "eyJpZCI6IngiLCJrZXkiOiJhbGljZS9jLmJpbiJ9" + token[dot:],
+	} {
+		if _, err := ss.verify(bad); status.Code(err) != codes.Unauthenticated {
+			t.Errorf("%s: verify = %v, want %s", name, err, codes.Unauthenticated)
+		}
+	}
+}
+
+func TestShareExpiry(t *testing.T) {
+	dir := t.TempDir()
+	ss, err := loadShares(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, _, err := ss.issue("alice/c.bin", "alice", time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss.mu.Lock()
+	ss.links[link.Id].Expires = time.Now().Unix()
+	ss.mu.Unlock()
+	if _, err = ss.use(link.Id); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("use of an expired link = %v, want %s", err, codes.PermissionDenied)
+	}
+
+	//expired links are not kept
+	if _, _, err = ss.issue("alice/d.bin", "alice", time.Hour, 0); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := loadShares(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := reloaded.links[link.Id]; ok {
+		t.Error("the expired link was saved")
+	}
+	if _, err = reloaded.use(link.Id); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("use after a restart = %v, want %s", err, codes.PermissionDenied)
+	}
+}
+
+func TestShareLimit(t *testing.T) {
+	dir := t.TempDir()
+	ss, err := loadShares(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, _, err := ss.issue("alice/c.bin", "alice", time.Hour, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		used int
+	)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := ss.use(link.Id); err == nil {
+				mu.Lock()
+				used++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if used != 3 {
+		t.Fatalf("%d concurrent downloads got through, want 3", used)
+	}
+
+	if err = ss.release(link.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ss.peek(link.Id); err != nil {
+		t.Errorf("peek after a release = %v", err)
+	}
+	if _, err = ss.use(link.Id); err != nil {
+		t.Errorf("use after a release = %v", err)
+	}
+	reloaded, err := loadShares(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = reloaded.use(link.Id); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("use after a restart = %v, want %s", err, codes.PermissionDenied)
+	}
+}
+
+func TestShareRevoke(t *testing.T) {
+	ss, err := loadShares(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	byId, _, err := ss.issue("alice/c.bin", "alice", time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, token, err := ss.issue("alice/c.bin", "alice", time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{byId.Id, token} {
+		if _, err = ss.revoke(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	id, err := ss.verify(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{byId.Id, id} {
+		if _, err = ss.peek(id); status.Code(err) != codes.PermissionDenied {
+			t.Errorf("peek of a revoked link = %v, want %s", err, codes.PermissionDenied)
+		}
+	}
+	if _, err = ss.revoke("unknown"); status.Code(err) != codes.NotFound {
+		t.Errorf("revoke of an unknown link = %v, want %s", err, codes.NotFound)
+	}
+}
+
+// shareGet sends a request for url and gives the status and the body.
+func shareGet(t *testing.T, method string, url string, header http.Header) (int, []byte) {
+	t.Helper()
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header = header
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode, data
+}
+
+func TestShareLinks(t *testing.T) {
+	ts := startTestServer(t)
+	c := ts.client(t)
+	data := randomBytes(4, 3*chunk_size)
+	if err := c.Transfer(writeLocal(t, "c.bin", data)); err != nil {
+		t.Fatal(err)
+	}
+
+	link, err := c.Share("c.bin", 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := shareGet(t, http.MethodHead, link.GetUrl(), nil); code != http.StatusOK {
+		t.Errorf("head status %d", code)
+	}
+	code, got := shareGet(t, http.MethodGet, link.GetUrl(), http.Header{"Range": {"bytes=0-9"}})
+	if code != http.StatusPartialContent || !bytes.Equal(got, data[:10]) {
+		t.Fatalf("range status %d with %d bytes", code, len(got))
+	}
+	//nothing goes out for an unsatisfiable range
+	if code, _ = shareGet(t, http.MethodGet, link.GetUrl(), http.Header{"Range": {"bytes=999999999-"}}); code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("range past the end status %d", code)
+	}
+	if code, got = shareGet(t, http.MethodGet, link.GetUrl(), nil); code != http.StatusOK || !bytes.Equal(got, data) {
+		t.Fatalf("get status %d with %d bytes", code, len(got))
+	}
+	if code, _ = shareGet(t, http.MethodGet, link.GetUrl(), nil); code != http.StatusForbidden {
+		t.Errorf("get of a used up link status %d, want %d", code, http.StatusForbidden)
+	}
+	if code, _ = shareGet(t, http.MethodHead, link.GetUrl(), nil); code != http.StatusForbidden {
+		t.Errorf("head of a used up link status %d, want %d", code, http.StatusForbidden)
+	}
+
+	//the name of the file comes from the server
+	link, err = c.Share("c.bin", 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err = os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	local, err := c.DownloadShared(link.GetToken(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err = ioutil.ReadFile(filepath.Join(dir, "c.bin")); local != "c.bin" || err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("downloaded to %q, %d bytes, %v", local, len(got), err)
+	}
+	if _, err = c.DownloadShared(link.GetToken(), filepath.Join(dir, "again.bin")); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("grpc download of a used up link = %v, want %s", err, codes.PermissionDenied)
+	}
+
+	link, err = c.Share("c.bin", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.RevokeShare(link.GetId()); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ = shareGet(t, http.MethodGet, link.GetUrl(), nil); code != http.StatusForbidden {
+		t.Errorf("get of a revoked link status %d, want %d", code, http.StatusForbidden)
+	}
+	if _, err = c.DownloadShared(link.GetToken(), filepath.Join(dir, "revoked.bin")); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("grpc download of a revoked link = %v, want %s", err, codes.PermissionDenied)
+	}
+}
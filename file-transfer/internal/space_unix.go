@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package internal
+
+import "syscall"
+
+// FreeSpace is what unprivileged users may still write below the root.
+func (ls *localStorage) FreeSpace() (int64, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(ls.root, &fs); err != nil {
+		return 0, err
+	}
+	return int64(fs.Bavail) * int64(fs.Bsize), nil
+}
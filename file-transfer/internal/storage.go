@@ -0,0 +1,78 @@
+package internal
+
+import (
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrInvalidKey is returned for keys a storage refuses to hold, such as
+// local names that link out of the store.
+var ErrInvalidKey = errors.New("invalid key")
+
+// FileInfo describes a committed file, Name is its key in the storage.
+type FileInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// StagedFile holds an upload before it is committed, chunks may arrive
+// at any offset and in any order.
+type StagedFile interface {
+	io.WriterAt
+	io.ReaderAt
+	io.Closer
+}
+
+// StoredFile is a committed file opened for reading, Info describes the
+// version being read.
+type StoredFile interface {
+	io.ReaderAt
+	io.Closer
+	Info() FileInfo
+}
+
+// Storage keeps the files of a server. Keys are clean slash separated
+// names, uploads are staged under their session id and only show up
+// under their key once committed. Missing files and uploads are reported
+// with errors that satisfy os.IsNotExist.
+type Storage interface {
+	// Create stages a new empty upload.
+	Create(id string) (StagedFile, error)
+	// OpenStaged opens an upload staged earlier, possibly by another
+	// stream or an earlier server.
+	OpenStaged(id string) (StagedFile, error)
+	// Commit publishes the first size bytes staged under id as key,
+	// replacing what was there.
+	Commit(id string, key string, size int64) error
+	// Abort drops the upload staged under id.
+	Abort(id string) error
+
+	Open(key string) (StoredFile, error)
+	Stat(key string) (FileInfo, error)
+	// List returns every file whose key starts with prefix.
+	List(prefix string) ([]FileInfo, error)
+	Delete(key string) error
+	// Rename fails with an os.IsExist error when to is taken.
+	Rename(from string, to string) error
+}
+
+func notExist(op string, key string) error {
+	return &os.PathError{Op: op, Path: key, Err: os.ErrNotExist}
+}
+
+// offsetWriter turns sequential writes into WriteAt calls on a staged
+// file.
+type offsetWriter struct {
+	w      io.WriterAt
+	offset int64
+}
+
+func (ow *offsetWriter) Write(p []byte) (int, error) {
+	n, err := ow.w.WriteAt(p, ow.offset)
+	ow.offset += int64(n)
+	return n, err
+}
@@ -0,0 +1,233 @@
+package internal
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// testStorages are the backends that have to behave the same.
+func testStorages(t *testing.T) map[string]Storage {
+	root, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(root) })
+	_, s3 := newTestS3Storage(t, min_part_size)
+	return map[string]Storage{
+		"memory": NewMemoryStorage(),
+		"local":  NewLocalStorage(root),
+		"s3":     s3,
+	}
+}
+
+func forEachStorage(t *testing.T, test func(t *testing.T, s Storage)) {
+	for name, s := range testStorages(t) {
+		s := s
+		t.Run(name, func(t *testing.T) {
+			test(t, s)
+		})
+	}
+}
+
+func readAll(t *testing.T, s Storage, key string) []byte {
+	t.Helper()
+	file, err := s.Open(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(io.NewSectionReader(file, 0, file.Info().Size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestStorageStageAndCommit(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, s Storage) {
+		data := []byte("0123456789abcdefghij")
+		staged, err := s.Create("up1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		//chunks arrive out of order and from other streams
+		if _, err = staged.WriteAt(data[10:], 10); err != nil {
+			t.Fatal(err)
+		}
+		staged.Close()
+		other, err := s.OpenStaged("up1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = other.WriteAt(data[:10], 0); err != nil {
+			t.Fatal(err)
+		}
+		back := make([]byte, len(data))
+		if _, err = other.ReadAt(back, 0); err != nil || !bytes.Equal(back, data) {
+			t.Fatalf("staged data reads back as %q, %v", back, err)
+		}
+		other.Close()
+
+		if _, err = s.Stat("dir/a.txt"); !os.IsNotExist(err) {
+			t.Fatalf("staged upload is visible: %v", err)
+		}
+		if err = s.Commit("up1", "dir/a.txt", int64(len(data))); err != nil {
+			t.Fatal(err)
+		}
+		info, err := s.Stat("dir/a.txt")
+		if err != nil || info.Name != "dir/a.txt" || info.Size != int64(len(data)) {
+			t.Fatalf("stat %+v, %v", info, err)
+		}
+		if got := readAll(t, s, "dir/a.txt"); !bytes.Equal(got, data) {
+			t.Errorf("committed %q", got)
+		}
+		if _, err = s.OpenStaged("up1"); !os.IsNotExist(err) {
+			t.Errorf("upload still staged after commit: %v", err)
+		}
+	})
+}
+
+func TestStorageCommitTruncatesAndReplaces(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, s Storage) {
+		stage(t, s, "up1", []byte("first version"))
+		if err := s.Commit("up1", "a", 5); err != nil {
+			t.Fatal(err)
+		}
+		if got := readAll(t, s, "a"); string(got) != "first" {
+			t.Fatalf("committed %q", got)
+		}
+		stage(t, s, "up2", []byte("second"))
+		if err := s.Commit("up2", "a", 6); err != nil {
+			t.Fatal(err)
+		}
+		if got := readAll(t, s, "a"); string(got) != "second" {
+			t.Errorf("replaced with %q", got)
+		}
+		stage(t, s, "up3", nil)
+		if err := s.Commit("up3", "empty", 0); err != nil {
+			t.Fatal(err)
+		}
+		if info, err := s.Stat("empty"); err != nil || info.Size != 0 {
+			t.Errorf("empty file %+v, %v", info, err)
+		}
+	})
+}
+
+func TestStorageAbort(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, s Storage) {
+		stage(t, s, "up1", []byte("data"))
+		if err := s.Abort("up1"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.OpenStaged("up1"); !os.IsNotExist(err) {
+			t.Errorf("aborted upload opens: %v", err)
+		}
+		if err := s.Commit("up1", "a", 4); !os.IsNotExist(err) {
+			t.Errorf("aborted upload commits: %v", err)
+		}
+		if err := s.Abort("never"); err != nil {
+			t.Errorf("abort of an unknown upload: %v", err)
+		}
+	})
+}
+
+func TestStorageReadAt(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, s Storage) {
+		stage(t, s, "up1", []byte("0123456789"))
+		if err := s.Commit("up1", "a", 10); err != nil {
+			t.Fatal(err)
+		}
+		file, err := s.Open("a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		p := make([]byte, 4)
+		if n, err := file.ReadAt(p, 3); err != nil || string(p[:n]) != "3456" {
+			t.Errorf("read at 3: %q, %v", p[:n], err)
+		}
+		if n, err := file.ReadAt(p, 8); err != io.EOF || string(p[:n]) != "89" {
+			t.Errorf("read at 8: %q, %v", p[:n], err)
+		}
+		if n, err := file.ReadAt(p, 10); err != io.EOF || n != 0 {
+			t.Errorf("read at the end: %d, %v", n, err)
+		}
+	})
+}
+
+func TestStorageListDeleteRename(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, s Storage) {
+		for i, key := range []string{"u1/a", "u1/dir/b", "u2/c"} {
+			id := "up" + string(rune('0'+i))
+			stage(t, s, id, []byte(key))
+			if err := s.Commit(id, key, int64(len(key))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		//an open upload is not a file yet
+		stage(t, s, "open", []byte("open"))
+
+		list := func(prefix string) string {
+			files, err := s.List(prefix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, f := range files {
+				names = append(names, f.Name)
+			}
+			sort.Strings(names)
+			return strings.Join(names, ",")
+		}
+		if got := list(""); got != "u1/a,u1/dir/b,u2/c" {
+			t.Errorf("listed %s", got)
+		}
+		if got := list("u1/"); got != "u1/a,u1/dir/b" {
+			t.Errorf("listed %s below u1/", got)
+		}
+
+		if err := s.Rename("u1/a", "u2/c"); !os.IsExist(err) {
+			t.Errorf("rename onto a taken key: %v", err)
+		}
+		if err := s.Rename("u1/a", "u3/moved"); err != nil {
+			t.Fatal(err)
+		}
+		if got := readAll(t, s, "u3/moved"); string(got) != "u1/a" {
+			t.Errorf("renamed file holds %q", got)
+		}
+		if err := s.Delete("u1/dir/b"); err != nil {
+			t.Fatal(err)
+		}
+		if got := list(""); got != "u2/c,u3/moved" {
+			t.Errorf("listed %s after rename and delete", got)
+		}
+	})
+}
+
+func TestStorageMissingKeys(t *testing.T) {
+	forEachStorage(t, func(t *testing.T, s Storage) {
+		if _, err := s.Open("missing"); !os.IsNotExist(err) {
+			t.Errorf("open: %v", err)
+		}
+		if _, err := s.Stat("missing"); !os.IsNotExist(err) {
+			t.Errorf("stat: %v", err)
+		}
+		if err := s.Delete("missing"); !os.IsNotExist(err) {
+			t.Errorf("delete: %v", err)
+		}
+		if err := s.Rename("missing", "other"); !os.IsNotExist(err) {
+			t.Errorf("rename: %v", err)
+		}
+		if _, err := s.OpenStaged("missing"); !os.IsNotExist(err) {
+			t.Errorf("open staged: %v", err)
+		}
+		if files, err := s.List(""); err != nil || len(files) != 0 {
+			t.Errorf("list of an empty storage: %v, %v", files, err)
+		}
+	})
+}
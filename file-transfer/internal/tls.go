@@ -0,0 +1,110 @@
+package internal
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// certReloader hands out the server certificate and the client CA pool
+// read from disk, reload swaps them without touching the listener.
+type certReloader struct {
+	certFile     string
+	keyFile      string
+	clientCaFile string
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+func newCertReloader(certFile string, keyFile string, clientCaFile string) (*certReloader, error) {
+	r := &certReloader{
+		certFile:     certFile,
+		keyFile:      keyFile,
+		clientCaFile: clientCaFile,
+	}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return errors.Wrap(err, "failed to load server certificate")
+	}
+	var clientCAs *x509.CertPool
+	if r.clientCaFile != "" {
+		if clientCAs, err = loadCertPool(r.clientCaFile); err != nil {
+			return err
+		}
+	}
+
+	r.mu.Lock()
+	r.cert = &cert
+	r.clientCAs = clientCAs
+	r.mu.Unlock()
+	return nil
+}
+
+// config is the tls config of the listener, every handshake picks up
+// whatever was loaded last.
+func (r *certReloader) config() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+			conf := &tls.Config{
+				Certificates: []tls.Certificate{*r.cert},
+				NextProtos:   []string{"h2"},
+				MinVersion:   tls.VersionTLS12,
+			}
+			if r.clientCAs != nil {
+				conf.ClientAuth = tls.RequireAndVerifyClientCert
+				conf.ClientCAs = r.clientCAs
+			}
+			return conf, nil
+		},
+	}
+}
+
+// clientTLSConfig trusts the CAs in caFile, or the system pool when it is
+// empty, and presents the certificate in certFile when one is given.
+func clientTLSConfig(caFile string, serverName string, certFile string, keyFile string) (*tls.Config, error) {
+	conf := &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = pool
+	}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load client certificate")
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf, nil
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.Errorf("no certificates found in %s", caFile)
+	}
+	return pool, nil
+}
@@ -0,0 +1,80 @@
+package internal
+
+import (
+	"time"
+
+	grpc_prometheus "github.com/grpc-ecosystem/go-grpc-prometheus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// failure reasons of file_transfer_failures_total
+const (
+	failure_digest     string = "digest_mismatch"
+	failure_size_limit string = "size_limit"
+	failure_quota      string = "quota"
+	failure_disk_space string = "disk_space"
+	failure_commit     string = "commit"
+	failure_patch      string = "patch"
+)
+
+// transferMetrics counts what the server receives and serves it together
+// with the grpc metrics of its interceptors.
+type transferMetrics struct {
+	registry *prometheus.Registry
+	grpc     *grpc_prometheus.ServerMetrics
+
+	receivedBytes  prometheus.Counter
+	committedFiles prometheus.Counter
+	failures       *prometheus.CounterVec
+	uploadDuration prometheus.Histogram
+	uploadSize     prometheus.Histogram
+}
+
+// newTransferMetrics reports activeSessions as the number of open uploads.
+func newTransferMetrics(activeSessions func() float64) *transferMetrics {
+	m := &transferMetrics{
+		registry: prometheus.NewRegistry(),
+		grpc:     grpc_prometheus.NewServerMetrics(),
+		receivedBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "file_transfer_received_bytes_total",
+			Help: "Bytes of file data received by uploads.",
+		}),
+		committedFiles: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "file_transfer_committed_files_total",
+			Help: "Uploads committed to the storage.",
+		}),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "file_transfer_failures_total",
+			Help: "Uploads rejected or failed by reason.",
+		}, []string{"reason"}),
+		uploadDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "file_transfer_upload_duration_seconds",
+			Help:    "Time from opening to committing an upload.",
+			Buckets: []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600},
+		}),
+		uploadSize: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "file_transfer_upload_size_bytes",
+			Help:    "Size of committed uploads.",
+			Buckets: prometheus.ExponentialBuckets(1024, 16, 7),
+		}),
+	}
+	m.grpc.EnableHandlingTimeHistogram()
+	m.registry.MustRegister(
+		m.receivedBytes, m.committedFiles, m.failures, m.uploadDuration, m.uploadSize,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "file_transfer_active_sessions",
+			Help: "Upload sessions open on the server.",
+		}, activeSessions),
+		m.grpc,
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// committed records an upload of size bytes that took since created.
+func (m *transferMetrics) committed(size int64, created time.Time) {
+	m.committedFiles.Inc()
+	m.uploadSize.Observe(float64(size))
+	m.uploadDuration.Observe(time.Since(created).Seconds())
+}
@@ -0,0 +1,134 @@
+package internal
+
+import (
+	"fmt"
+	"hash"
+	"io"
+	"sync"
+	"time"
+	"wangweizZZ/go-daily-study/file-transfer/internal/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// upload is the server side state of one file being written, possibly by
+// several Write streams at once.
+type upload struct {
+	mu sync.Mutex
+
+	id         string
+	name       string
+	owner      string
+	size       int64
+	digestType proto.DigestType
+	md5        string
+	received   rangeSet
+	created    time.Time
+
+	// digest has seen every byte before hashed, chunks arriving in order
+	// are hashed on the fly and the rest is read back on commit.
+	digest   hash.Hash
+	hashed   int64
+	expected string
+
+	// result is set once the upload has been committed or rejected.
+	result *proto.ChunkResult
+
+	// growing uploads take the body of a PUT without a length, size is
+	// what arrived so far. Nothing could resume them, so they are neither
+	// saved nor joined.
+	growing bool
+}
+
+func newUpload(id string, name string, owner string, size int64, digestType proto.DigestType, md5 string) (*upload, error) {
+	digest, err := newDigest(digestType)
+	if err != nil {
+		return nil, err
+	}
+	return &upload{
+		id:         id,
+		name:       name,
+		owner:      owner,
+		size:       size,
+		digestType: digestType,
+		md5:        md5,
+		digest:     digest,
+		created:    time.Now(),
+	}, nil
+}
+
+// write stores one chunk at its declared offset.
+func (u *upload) write(file io.WriterAt, chunk *proto.Chunk) error {
+	offset, content := chunk.GetOffset(), chunk.GetContent()
+	if chunk.GetId() != u.id {
+		return status.Errorf(codes.InvalidArgument, "chunk for upload %s sent on upload %s", chunk.GetId(), u.id)
+	}
+	if offset < 0 || offset+int64(len(content)) > u.size {
+		return status.Errorf(codes.OutOfRange, "chunk [%d, %d) is outside of upload %s with size %d",
+			offset, offset+int64(len(content)), u.id, u.size)
+	}
+	if _, err := file.WriteAt(content, offset); err != nil {
+		return err
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	end := offset + int64(len(content))
+	u.received = u.received.add(offset, end)
+	if offset <= u.hashed && u.hashed < end {
+		u.digest.Write(content[u.hashed-offset:])
+		u.hashed = end
+	}
+	if chunk.GetDigest() != "" {
+		u.expected = chunk.GetDigest()
+	}
+	return nil
+}
+
+// finish is called whenever a Write stream ends. The file is verified and
+// committed by the first stream that sees every range present.
+func (u *upload) finish(file io.ReaderAt, commit func() error, abort func()) (*proto.ChunkResult, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.result != nil {
+		return u.result, nil
+	}
+	if !u.received.covers(u.size) {
+		return &proto.ChunkResult{
+			Offset:  u.received.contiguous(),
+			Code:    proto.ResultCode_Unknown,
+			Message: "waiting for the remaining ranges",
+		}, nil
+	}
+
+	if u.hashed < u.size {
+		if _, err := io.Copy(u.digest, io.NewSectionReader(file, u.hashed, u.size-u.hashed)); err != nil {
+			return nil, err
+		}
+		u.hashed = u.size
+	}
+
+	expected := u.expected
+	if expected == "" && u.digestType == proto.DigestType_Md5 {
+		expected = u.md5
+	}
+	if actual := sumHex(u.digest); expected != "" && actual != expected {
+		abort()
+		u.result = &proto.ChunkResult{
+			Offset:  u.size,
+			Code:    proto.ResultCode_Failed,
+			Message: fmt.Sprintf("%s mismatch: expected %s, got %s", u.digestType, expected, actual),
+		}
+		return u.result, nil
+	}
+
+	if err := commit(); err != nil {
+		return nil, err
+	}
+	u.result = &proto.ChunkResult{
+		Offset: u.size,
+		Code:   proto.ResultCode_Ok,
+	}
+	return u.result, nil
+}
@@ -0,0 +1,144 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+	"wangweizZZ/go-daily-study/file-transfer/internal/proto"
+)
+
+// memFile is a fixed size file in memory.
+type memFile []byte
+
+func (f memFile) WriteAt(p []byte, off int64) (int, error) {
+	return copy(f[off:], p), nil
+}
+
+func (f memFile) ReadAt(p []byte, off int64) (int, error) {
+	return bytes.NewReader(f).ReadAt(p, off)
+}
+
+func testUpload(t *testing.T, size int64) *upload {
+	t.Helper()
+	up, err := newUpload("id", "name", "", size, proto.DigestType_Sha256, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return up
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestUploadFinish(t *testing.T) {
+	data := []byte("0123456789abcdefghij")
+	tests := []struct {
+		name string
+		// chunks are written in this order as [start, end)
+		chunks [][2]int64
+		digest string
+		code   proto.ResultCode
+		offset int64
+	}{
+		{"in order", [][2]int64{{0, 10}, {10, 20}}, sha256Hex(data), proto.ResultCode_Ok, 20},
+		{"out of order", [][2]int64{{15, 20}, {5, 15}, {0, 5}}, sha256Hex(data), proto.ResultCode_Ok, 20},
+		{"overlapping", [][2]int64{{0, 12}, {8, 20}}, sha256Hex(data), proto.ResultCode_Ok, 20},
+		{"no digest", [][2]int64{{0, 20}}, "", proto.ResultCode_Ok, 20},
+		{"gap in the middle", [][2]int64{{0, 5}, {10, 20}}, sha256Hex(data), proto.ResultCode_Unknown, 5},
+		{"missing head", [][2]int64{{5, 20}}, sha256Hex(data), proto.ResultCode_Unknown, 0},
+		{"missing tail", [][2]int64{{0, 19}}, sha256Hex(data), proto.ResultCode_Unknown, 19},
+		{"digest mismatch", [][2]int64{{0, 20}}, sha256Hex([]byte("other")), proto.ResultCode_Failed, 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			up := testUpload(t, int64(len(data)))
+			file := make(memFile, len(data))
+			for i, c := range tt.chunks {
+				chunk := &proto.Chunk{Id: up.id, Offset: c[0], Content: data[c[0]:c[1]]}
+				if i == len(tt.chunks)-1 {
+					chunk.Digest = tt.digest
+				}
+				if err := up.write(file, chunk); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var commits, aborts int
+			result, err := up.finish(file, func() error { commits++; return nil }, func() { aborts++ })
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.GetCode() != tt.code || result.GetOffset() != tt.offset {
+				t.Fatalf("got %s at %d, want %s at %d", result.GetCode(), result.GetOffset(), tt.code, tt.offset)
+			}
+			wantCommits, wantAborts := 0, 0
+			switch tt.code {
+			case proto.ResultCode_Ok:
+				wantCommits = 1
+			case proto.ResultCode_Failed:
+				wantAborts = 1
+			}
+			if commits != wantCommits || aborts != wantAborts {
+				t.Errorf("committed %d and aborted %d times, want %d and %d", commits, aborts, wantCommits, wantAborts)
+			}
+			if tt.code == proto.ResultCode_Ok && !bytes.Equal(file, data) {
+				t.Errorf("file is %q", file)
+			}
+		})
+	}
+}
+
+func TestUploadFinishOnce(t *testing.T) {
+	data := []byte("0123456789")
+	up := testUpload(t, int64(len(data)))
+	file := make(memFile, len(data))
+
+	var commits int
+	commit := func() error { commits++; return nil }
+	//the first stream ends before the second sent its range
+	if err := up.write(file, &proto.Chunk{Id: up.id, Offset: 5, Content: data[5:]}); err != nil {
+		t.Fatal(err)
+	}
+	result, err := up.finish(file, commit, func() {})
+	if err != nil || result.GetCode() != proto.ResultCode_Unknown {
+		t.Fatalf("got %v, %v before the file was complete", result, err)
+	}
+	if err = up.write(file, &proto.Chunk{Id: up.id, Offset: 0, Content: data[:5], Digest: sha256Hex(data)}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		result, err = up.finish(file, commit, func() {})
+		if err != nil || result.GetCode() != proto.ResultCode_Ok {
+			t.Fatalf("got %v, %v once the file was complete", result, err)
+		}
+	}
+	if commits != 1 {
+		t.Errorf("committed %d times", commits)
+	}
+}
+
+func TestUploadWriteRejects(t *testing.T) {
+	tests := []struct {
+		name  string
+		chunk *proto.Chunk
+	}{
+		{"other upload", &proto.Chunk{Id: "other", Offset: 0, Content: []byte("ab")}},
+		{"negative offset", &proto.Chunk{Id: "id", Offset: -1, Content: []byte("ab")}},
+		{"past the end", &proto.Chunk{Id: "id", Offset: 9, Content: []byte("ab")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			up := testUpload(t, 10)
+			file := make(memFile, 10)
+			if err := up.write(file, tt.chunk); err == nil {
+				t.Fatal("chunk was accepted")
+			}
+			if len(up.received) != 0 {
+				t.Errorf("received %v", up.received)
+			}
+		})
+	}
+}
@@ -0,0 +1,443 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// WatchOptions tells Watch which files to send and what becomes of them
+// once the server committed them.
+type WatchOptions struct {
+	Include []string
+	Exclude []string
+	// Stable is how long a file must go without writes before it is sent.
+	Stable time.Duration
+	// PollInterval is how often the directory is walked when inotify is
+	// not available or Poll is set.
+	PollInterval time.Duration
+	Poll         bool
+	// MoveTo receives committed files under their path below the
+	// directory, Delete removes them instead. Files left in place are
+	// sent again once they change.
+	MoveTo string
+	Delete bool
+	// StateFile keeps the size and modification time of the files the
+	// server committed, so files left in place are not sent again after
+	// a restart. It defaults to watch_state_file in the directory.
+	StateFile string
+}
+
+// watch_state_file is the default StateFile, it is never sent.
+const watch_state_file string = ".watch_state"
+
+// dirWatcher reports paths below a directory that may have changed, a
+// directory stands for everything below it. Changes closes when the
+// watcher fails.
+type dirWatcher interface {
+	Changes() <-chan string
+	Close() error
+}
+
+// pollWatcher reports the whole directory every interval.
+type pollWatcher struct {
+	changes chan string
+	done    chan struct{}
+}
+
+func newPollWatcher(root string, interval time.Duration) dirWatcher {
+	w := &pollWatcher{changes: make(chan string), done: make(chan struct{})}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.done:
+				return
+			case <-ticker.C:
+			}
+			select {
+			case w.changes <- root:
+			case <-w.done:
+				return
+			}
+		}
+	}()
+	return w
+}
+
+func (w *pollWatcher) Changes() <-chan string {
+	return w.changes
+}
+
+func (w *pollWatcher) Close() error {
+	close(w.done)
+	return nil
+}
+
+// watchedFile is a file of the directory as it was last seen.
+type watchedFile struct {
+	size    int64
+	modTime time.Time
+	// since is when the file was last seen changing
+	since time.Time
+	sent  bool
+
+	failures int
+	retryAt  time.Time
+}
+
+// watchState is a file as the server confirmed it, keyed by its name in
+// the state file.
+type watchState struct {
+	Size    int64 `json:"size"`
+	ModTime int64 `json:"mod_time"`
+}
+
+// dirSync sends the files of a watched directory. The files are only
+// touched by the loop of Watch, the uploads run on a worker of their own.
+type dirSync struct {
+	c     *grpcClient
+	dir   string
+	opts  WatchOptions
+	log   *Logger
+	files map[string]*watchedFile
+	// confirmed is the state file as it was loaded
+	confirmed map[string]watchState
+	// sending is what the worker sends now, as it was when queued
+	sending map[string]watchState
+	batches chan []TransferResult
+	results chan []TransferResult
+}
+
+// Watch sends the files below dir as they appear or change, once they
+// went opts.Stable without writes, until ctx ends. Uploads that are
+// running when ctx ends are finished first.
+func (c *grpcClient) Watch(ctx context.Context, dir string, opts WatchOptions) error {
+	dir = filepath.Clean(dir)
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return errors.Errorf("%s is not a directory", dir)
+	}
+	if opts.MoveTo != "" {
+		if opts.MoveTo, err = filepath.Abs(opts.MoveTo); err != nil {
+			return err
+		}
+	}
+	if err = c.initConn(); err != nil {
+		return err
+	}
+
+	if opts.StateFile == "" {
+		opts.StateFile = filepath.Join(dir, watch_state_file)
+	}
+	if opts.StateFile, err = filepath.Abs(opts.StateFile); err != nil {
+		return err
+	}
+
+	ds := &dirSync{
+		c:       c,
+		dir:     dir,
+		opts:    opts,
+		log:     c.log.With("dir", dir),
+		files:   make(map[string]*watchedFile),
+		sending: make(map[string]watchState),
+		batches: make(chan []TransferResult),
+		results: make(chan []TransferResult),
+	}
+	if ds.confirmed, err = loadWatchState(opts.StateFile); err != nil {
+		return err
+	}
+	var watcher dirWatcher
+	if !opts.Poll {
+		if watcher, err = newDirWatcher(dir); err != nil {
+			ds.log.Warn("inotify not available, polling", "interval", opts.PollInterval, "error", err)
+		}
+	}
+	if watcher == nil {
+		watcher = newPollWatcher(dir, opts.PollInterval)
+	}
+	defer watcher.Close()
+	ds.log.Info("watching directory", "stable", opts.Stable)
+
+	//files that are there already are sent too
+	ds.scan(dir)
+	tick := opts.Stable / 4
+	if tick < 100*time.Millisecond {
+		tick = 100 * time.Millisecond
+	} else if tick > time.Second {
+		tick = time.Second
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	//one batch at a time, so the loop keeps noting changes meanwhile
+	go func() {
+		for batch := range ds.batches {
+			ds.results <- ds.c.transferAll(batch, ds.c.config.jobs)
+		}
+	}()
+	defer func() {
+		if len(ds.sending) > 0 {
+			ds.log.Info("finishing uploads", "files", len(ds.sending))
+			ds.finish(<-ds.results)
+		}
+		close(ds.batches)
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			ds.log.Info("stopped watching directory")
+			return nil
+		case path, ok := <-watcher.Changes():
+			if !ok {
+				return errors.Errorf("watching %s failed", dir)
+			}
+			ds.scan(path)
+		case <-ticker.C:
+			ds.send()
+		case results := <-ds.results:
+			ds.finish(results)
+		}
+	}
+}
+
+// scan notes the files at and below path, files that are gone are
+// forgotten.
+func (ds *dirSync) scan(path string) {
+	seen := make(map[string]bool)
+	err := filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		name, ok := ds.name(p)
+		if !ok {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() || !info.Mode().IsRegular() {
+			return nil
+		}
+		if len(ds.opts.Include) > 0 && !matchAny(ds.opts.Include, name) {
+			return nil
+		}
+		seen[p] = true
+		ds.note(p, info)
+		return nil
+	})
+	if err != nil {
+		ds.log.Warn("failed to scan", "path", path, "error", err)
+		return
+	}
+	prefix := path + string(os.PathSeparator)
+	for p := range ds.files {
+		if !seen[p] && (p == path || strings.HasPrefix(p, prefix)) {
+			delete(ds.files, p)
+		}
+	}
+}
+
+// name is the remote name of the local path, false for paths that are
+// not sent: excluded ones, unfinished .tmp files and the move_to
+// directory.
+func (ds *dirSync) name(path string) (string, bool) {
+	rel, err := filepath.Rel(ds.dir, path)
+	if err != nil {
+		return "", false
+	}
+	name := filepath.ToSlash(rel)
+	if name == "." {
+		return name, true
+	}
+	if strings.HasSuffix(name, tmp_file_suffix) {
+		return "", false
+	}
+	if abs, err := filepath.Abs(path); err != nil || abs == ds.opts.StateFile {
+		return "", false
+	}
+	//events name paths deep inside excluded directories too
+	for i := range name {
+		if name[i] == '/' && matchAny(ds.opts.Exclude, name[:i]) {
+			return "", false
+		}
+	}
+	if matchAny(ds.opts.Exclude, name) {
+		return "", false
+	}
+	if ds.opts.MoveTo != "" {
+		abs, err := filepath.Abs(path)
+		if err != nil || abs == ds.opts.MoveTo || strings.HasPrefix(abs, ds.opts.MoveTo+string(os.PathSeparator)) {
+			return "", false
+		}
+	}
+	return name, true
+}
+
+// note records what path looks like now, a change restarts its wait.
+func (ds *dirSync) note(path string, info os.FileInfo) {
+	f, ok := ds.files[path]
+	if !ok {
+		f = &watchedFile{size: info.Size(), modTime: info.ModTime(), since: time.Now()}
+		//unchanged since the server confirmed it before a restart
+		name, _ := ds.name(path)
+		if st, ok := ds.confirmed[name]; ok && st.Size == f.size && st.ModTime == f.modTime.UnixNano() {
+			f.sent = true
+		}
+		ds.files[path] = f
+		return
+	}
+	if f.size != info.Size() || !f.modTime.Equal(info.ModTime()) {
+		f.size, f.modTime, f.since, f.sent = info.Size(), info.ModTime(), time.Now(), false
+		f.failures, f.retryAt = 0, time.Time{}
+	}
+}
+
+// send hands the files that went long enough without writes to the
+// worker, unless it is busy.
+func (ds *dirSync) send() {
+	if len(ds.sending) > 0 {
+		return
+	}
+	now := time.Now()
+	var ready []TransferResult
+	for path, f := range ds.files {
+		if f.sent || now.Before(f.retryAt) {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			delete(ds.files, path)
+			continue
+		}
+		ds.note(path, info)
+		if now.Sub(f.since) >= ds.opts.Stable {
+			name, _ := ds.name(path)
+			ready = append(ready, TransferResult{Path: path, Name: name})
+			ds.sending[path] = watchState{Size: f.size, ModTime: f.modTime.UnixNano()}
+		}
+	}
+	if len(ready) > 0 {
+		ds.batches <- ready
+	}
+}
+
+// finish notes the results of a batch of the worker.
+func (ds *dirSync) finish(results []TransferResult) {
+	sent := false
+	for _, r := range results {
+		queued := ds.sending[r.Path]
+		delete(ds.sending, r.Path)
+		f, ok := ds.files[r.Path]
+		if !ok {
+			//gone while it was sent
+			continue
+		}
+		log := ds.log.With("file", r.Name, "path", r.Path)
+		if r.Err != nil {
+			f.failures++
+			wait := ds.opts.Stable << uint(f.failures)
+			if wait > ds.c.config.retry.MaxBackoff || wait <= 0 {
+				wait = ds.c.config.retry.MaxBackoff
+			}
+			f.retryAt = time.Now().Add(wait)
+			log.Warn("upload failed, trying again later", "failures", f.failures, "wait", wait, "error", r.Err)
+			continue
+		}
+		//what was committed may not be what is on disk by now
+		info, err := os.Stat(r.Path)
+		if err != nil || info.Size() != queued.Size || info.ModTime().UnixNano() != queued.ModTime {
+			if err == nil {
+				ds.note(r.Path, info)
+			}
+			log.Warn("file changed while it was sent, sending it again")
+			continue
+		}
+		f.sent = true
+		sent = true
+		log.Info("file sent")
+		ds.done(log, r.Path, r.Name)
+	}
+	if sent {
+		if err := ds.saveState(); err != nil {
+			ds.log.Warn("failed to save watch state", "path", ds.opts.StateFile, "error", err)
+		}
+	}
+}
+
+// loadWatchState reads the files a state file says the server confirmed,
+// none when there is no state file yet.
+func loadWatchState(path string) (map[string]watchState, error) {
+	confirmed := make(map[string]watchState)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return confirmed, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &confirmed); err != nil {
+		return nil, errors.Wrapf(err, "failed to load watch state %s", path)
+	}
+	return confirmed, nil
+}
+
+// saveState writes the files the server confirmed that are still in
+// place.
+func (ds *dirSync) saveState() error {
+	confirmed := make(map[string]watchState)
+	for path, f := range ds.files {
+		if !f.sent {
+			continue
+		}
+		name, _ := ds.name(path)
+		confirmed[name] = watchState{Size: f.size, ModTime: f.modTime.UnixNano()}
+	}
+	data, err := json.Marshal(confirmed)
+	if err != nil {
+		return err
+	}
+	//write aside and rename, like the sessions
+	if err = ioutil.WriteFile(ds.opts.StateFile+tmp_file_suffix, data, 0644); err != nil {
+		return err
+	}
+	if err = os.Rename(ds.opts.StateFile+tmp_file_suffix, ds.opts.StateFile); err != nil {
+		return err
+	}
+	ds.confirmed = confirmed
+	return nil
+}
+
+// done moves or deletes a committed file as asked.
+func (ds *dirSync) done(log *Logger, path string, name string) {
+	var err error
+	switch {
+	case ds.opts.Delete:
+		err = os.Remove(path)
+	case ds.opts.MoveTo != "":
+		target := filepath.Join(ds.opts.MoveTo, filepath.FromSlash(name))
+		if err = os.MkdirAll(filepath.Dir(target), 0755); err == nil {
+			err = os.Rename(path, target)
+		}
+	default:
+		return
+	}
+	if err != nil {
+		log.Error("failed to clean up sent file", "error", err)
+		return
+	}
+	delete(ds.files, path)
+}
@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/pkg/errors"
+)
+
+const inotify_mask uint32 = syscall.IN_CREATE | syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE |
+	syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM | syscall.IN_DELETE | syscall.IN_ATTRIB
+
+// inotifyWatcher watches a directory and every directory below it, new
+// directories are watched as they appear.
+type inotifyWatcher struct {
+	file    *os.File
+	fd      int
+	root    string
+	changes chan string
+	done    chan struct{}
+
+	mu    sync.Mutex
+	paths map[int32]string
+}
+
+func newDirWatcher(root string) (dirWatcher, error) {
+	//non blocking, so reads go through the runtime poller and Close ends them
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, errors.Wrap(err, "inotify")
+	}
+	w := &inotifyWatcher{
+		file:    os.NewFile(uintptr(fd), "inotify"),
+		fd:      fd,
+		root:    root,
+		changes: make(chan string, 256),
+		done:    make(chan struct{}),
+		paths:   make(map[int32]string),
+	}
+	if err = w.addTree(root); err != nil {
+		w.file.Close()
+		return nil, err
+	}
+	go w.read()
+	return w, nil
+}
+
+func (w *inotifyWatcher) Changes() <-chan string {
+	return w.changes
+}
+
+func (w *inotifyWatcher) Close() error {
+	close(w.done)
+	return w.file.Close()
+}
+
+// addTree watches dir and the directories below it.
+func (w *inotifyWatcher) addTree(dir string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			//gone again before it was watched
+			if os.IsNotExist(err) && path != dir {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			return nil
+		}
+		wd, err := syscall.InotifyAddWatch(w.fd, path, inotify_mask)
+		if err != nil {
+			return errors.Wrapf(err, "watch %s", path)
+		}
+		w.mu.Lock()
+		w.paths[int32(wd)] = path
+		w.mu.Unlock()
+		return nil
+	})
+}
+
+func (w *inotifyWatcher) read() {
+	defer close(w.changes)
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			return
+		}
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			name := strings.TrimRight(string(buf[nameStart:nameStart+int(event.Len)]), "\x00")
+			offset = nameStart + int(event.Len)
+
+			if !w.handle(event, name) {
+				return
+			}
+		}
+	}
+}
+
+// handle turns an event into a change, false once the watcher closed.
+func (w *inotifyWatcher) handle(event *syscall.InotifyEvent, name string) bool {
+	w.mu.Lock()
+	dir, ok := w.paths[event.Wd]
+	if event.Mask&syscall.IN_IGNORED != 0 {
+		delete(w.paths, event.Wd)
+	}
+	w.mu.Unlock()
+
+	var path string
+	switch {
+	case event.Mask&syscall.IN_Q_OVERFLOW != 0:
+		//events were lost, everything is looked at again
+		path = w.root
+	case !ok || event.Mask&syscall.IN_IGNORED != 0:
+		return true
+	case name == "":
+		path = dir
+	default:
+		path = filepath.Join(dir, name)
+	}
+	if event.Mask&syscall.IN_ISDIR != 0 && event.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+		//files may land in it before the watch is added, the change
+		//of the directory covers them
+		w.addTree(path)
+	}
+	select {
+	case w.changes <- path:
+		return true
+	case <-w.done:
+		return false
+	}
+}
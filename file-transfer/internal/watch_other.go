@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package internal
+
+import "github.com/pkg/errors"
+
+// newDirWatcher needs inotify, other systems poll.
+func newDirWatcher(root string) (dirWatcher, error) {
+	return nil, errors.New("inotify is only available on linux")
+}
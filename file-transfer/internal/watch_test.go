@@ -0,0 +1,68 @@
+package internal
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// watchUntil runs Watch on dir until cond holds, and waits for the
+// uploads it started to finish.
+func watchUntil(t *testing.T, c *grpcClient, dir string, what string, cond func() bool) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Watch(ctx, dir, WatchOptions{Stable: 50 * time.Millisecond, PollInterval: 50 * time.Millisecond, Poll: true})
+	}()
+	waitFor(t, what, cond)
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWatchSkipsConfirmedFiles(t *testing.T) {
+	ts := startTestServer(t)
+	c := ts.client(t)
+	dir := t.TempDir()
+	for name, data := range map[string]string{"a.txt": "first", "b.txt": "second"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	committed := func(n float64) func() bool {
+		return func() bool { return testutil.ToFloat64(ts.metrics.committedFiles) >= n }
+	}
+
+	watchUntil(t, c, dir, "both files", committed(2))
+	if _, err := os.Stat(filepath.Join(dir, watch_state_file)); err != nil {
+		t.Fatalf("no watch state: %v", err)
+	}
+	if _, err := c.Stat(watch_state_file); status.Code(err) != codes.NotFound {
+		t.Errorf("the watch state was sent: %v", err)
+	}
+
+	//only the file that changed goes again after a restart
+	if err := ioutil.WriteFile(filepath.Join(dir, "b.txt"), []byte("changed since"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	watchUntil(t, c, dir, "the changed file", committed(3))
+	if n := testutil.ToFloat64(ts.metrics.committedFiles); n != 3 {
+		t.Errorf("%v files committed, want 3", n)
+	}
+	stat, err := c.Stat("b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.GetSize() != int64(len("changed since")) {
+		t.Errorf("b.txt has %d bytes on the server", stat.GetSize())
+	}
+}
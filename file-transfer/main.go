@@ -1,6 +1,7 @@
 package main
 
 import (
+	"log"
 	"os"
 	"wangweizZZ/go-daily-study/file-transfer/cmd"
 
@@ -15,13 +16,31 @@ func main() {
 		Commands: []*cli.Command{
 			&cmd.Server,
 			&cmd.Client,
+			&cmd.Download,
+			&cmd.Ls,
+			&cmd.Stat,
+			&cmd.Rm,
+			&cmd.Mv,
+			&cmd.Limit,
+			&cmd.Transfers,
+			&cmd.Share,
+			&cmd.Unshare,
+			&cmd.Replication,
+			&cmd.Config,
 		},
 		Flags: []cli.Flag{
 			&cli.BoolFlag{
 				Name:  "debug",
-				Usage: "enables debug logging",
+				Usage: "enables debug logging, every chunk of an upload is traced",
 			},
+			&cli.BoolFlag{
+				Name:  "log_json",
+				Usage: "writes the log as one JSON object per line instead of key=value text",
+			},
+			cmd.ConfigFlag,
 		},
 	}
-	app.Run(os.Args)
+	if err := app.Run(os.Args); err != nil {
+		log.Fatal(err)
+	}
 }